@@ -0,0 +1,51 @@
+// Package config holds the operator-facing configuration for an nnet node,
+// threaded down into the overlay/chord package via NewChord.
+package config
+
+import "time"
+
+// Config holds the settings a caller passes to NewChord. NodeIDBytes, the
+// neighbor counts and BaseStabilizeInterval are used as given and have no
+// defaults. The remaining fields may be left at their zero value, which is
+// handled as each field describes (see, e.g., chord.orDefaultFloat for the
+// lookup rate limiter).
+type Config struct {
+	// NodeIDBytes is the length of a Chord node ID in bytes.
+	NodeIDBytes int
+
+	// MinNumSuccessors and MinNumPredecessors bound how many entries the
+	// successor and predecessor NeighborLists try to maintain.
+	MinNumSuccessors   int
+	MinNumPredecessors int
+
+	// NumFingerSuccessors bounds how many successors each fingerTable entry
+	// tries to maintain.
+	NumFingerSuccessors int
+
+	// BaseStabilizeInterval is the base interval NewChord's stabilization
+	// loops (updateSuccessors, updateFinger, ...) run on.
+	BaseStabilizeInterval time.Duration
+
+	// MaxPeerErrors is the error score threshold past which a peer is
+	// evicted from every NeighborList and placed on the backoff list. Zero
+	// disables eviction.
+	MaxPeerErrors int
+
+	// LookupRateLimitBurst and LookupRateLimitPerSec size and refill the
+	// token buckets guarding FindSuccessors/FindPredecessors/
+	// GetSuccAndPred. Zero falls back to the rate limiter's own defaults.
+	LookupRateLimitBurst  float64
+	LookupRateLimitPerSec float64
+
+	// LookupRateLimitIdleTimeout is how long a per-ID or per-address lookup
+	// rate limit bucket can sit unused before it is swept.
+	LookupRateLimitIdleTimeout time.Duration
+
+	// SecureTransport enables the Noise-IK encrypted transport for all
+	// Chord peer connections instead of the plaintext default.
+	SecureTransport bool
+
+	// LogFormat selects the Chord logger's output backend: "json" for
+	// structured, aggregation-friendly lines, anything else for text.
+	LogFormat string
+}
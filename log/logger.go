@@ -0,0 +1,194 @@
+// Package log provides the leveled logger used throughout nnet. Callers
+// that only need a handful of one-off lines can keep using the
+// package-level functions (Trace/Debug/Info/Warn/Error and their f variants),
+// which log through a shared default Logger. Subsystems that want
+// structured, contextual output (one key/value set reused across many log
+// lines, e.g. a Chord node's localID) should hold their own Logger obtained
+// via New or With instead.
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Level is a log severity, ordered from most to least verbose.
+type Level int
+
+const (
+	TraceLevel Level = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case TraceLevel:
+		return "TRACE"
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Logger is a leveled logger that carries an immutable set of key/value
+// pairs, attached via With, onto every line it emits. Implementations must
+// be safe for concurrent use.
+type Logger interface {
+	// With returns a child Logger with kv (alternating key, value, key,
+	// value, ...) merged into the current context. The receiver is left
+	// unmodified.
+	With(kv ...interface{}) Logger
+
+	Trace(args ...interface{})
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Backend is the wire format a Logger renders lines in. Selected via
+// config.Config so operators can pick text for local development and JSON
+// for log aggregation.
+type Backend int
+
+const (
+	TextBackend Backend = iota
+	JSONBackend
+)
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger Logger = New(TextBackend, os.Stderr, InfoLevel)
+)
+
+// SetDefault replaces the Logger the package-level functions (Error, Warnf,
+// ...) delegate to.
+func SetDefault(l Logger) {
+	defaultMu.Lock()
+	defaultLogger = l
+	defaultMu.Unlock()
+}
+
+// Default returns the Logger the package-level functions delegate to.
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// New creates a Logger writing to w at the given minimum level, rendered
+// with backend.
+func New(backend Backend, w io.Writer, level Level) Logger {
+	return &logger{backend: backend, w: w, level: level, mu: &sync.Mutex{}}
+}
+
+type logger struct {
+	backend Backend
+	w       io.Writer
+	level   Level
+	kv      []interface{}
+	mu      *sync.Mutex // shared with every child from With, since they share w
+}
+
+func (l *logger) With(kv ...interface{}) Logger {
+	merged := make([]interface{}, 0, len(l.kv)+len(kv))
+	merged = append(merged, l.kv...)
+	merged = append(merged, kv...)
+	return &logger{backend: l.backend, w: l.w, level: l.level, kv: merged, mu: l.mu}
+}
+
+func (l *logger) log(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch l.backend {
+	case JSONBackend:
+		writeJSONLine(l.w, level, msg, l.kv)
+	default:
+		writeTextLine(l.w, level, msg, l.kv)
+	}
+}
+
+func (l *logger) Trace(args ...interface{}) { l.log(TraceLevel, fmt.Sprint(args...)) }
+func (l *logger) Debug(args ...interface{}) { l.log(DebugLevel, fmt.Sprint(args...)) }
+func (l *logger) Info(args ...interface{})  { l.log(InfoLevel, fmt.Sprint(args...)) }
+func (l *logger) Warn(args ...interface{})  { l.log(WarnLevel, fmt.Sprint(args...)) }
+func (l *logger) Error(args ...interface{}) { l.log(ErrorLevel, fmt.Sprint(args...)) }
+
+func (l *logger) Tracef(format string, args ...interface{}) { l.log(TraceLevel, fmt.Sprintf(format, args...)) }
+func (l *logger) Debugf(format string, args ...interface{}) { l.log(DebugLevel, fmt.Sprintf(format, args...)) }
+func (l *logger) Infof(format string, args ...interface{})  { l.log(InfoLevel, fmt.Sprintf(format, args...)) }
+func (l *logger) Warnf(format string, args ...interface{})  { l.log(WarnLevel, fmt.Sprintf(format, args...)) }
+func (l *logger) Errorf(format string, args ...interface{}) { l.log(ErrorLevel, fmt.Sprintf(format, args...)) }
+
+func writeTextLine(w io.Writer, level Level, msg string, kv []interface{}) {
+	fmt.Fprintf(w, "%s [%s] %s", time.Now().Format(time.RFC3339Nano), level, msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(w, " %v=%v", kv[i], kv[i+1])
+	}
+	fmt.Fprintln(w)
+}
+
+func writeJSONLine(w io.Writer, level Level, msg string, kv []interface{}) {
+	fmt.Fprintf(w, `{"time":%q,"level":%q,"msg":%q`, time.Now().Format(time.RFC3339Nano), level.String(), msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(w, `,%q:`, fmt.Sprint(kv[i]))
+		writeJSONValue(w, kv[i+1])
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// writeJSONValue renders v as a single JSON scalar. Numbers and bools are
+// written unquoted so fields like latencyMs and fingerIndex come through as
+// real JSON numbers that a log pipeline can aggregate, rather than strings
+// that need a second parse; everything else (including errors, via Error())
+// is quoted as a JSON string.
+func writeJSONValue(w io.Writer, v interface{}) {
+	switch val := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		fmt.Fprintf(w, "%v", val)
+	case error:
+		fmt.Fprintf(w, "%q", val.Error())
+	default:
+		fmt.Fprintf(w, "%q", fmt.Sprint(val))
+	}
+}
+
+// The package-level functions below log through Default() so existing call
+// sites (log.Error(err), log.Warnf("...", x)) keep working unchanged for
+// callers that don't need a contextual child Logger.
+
+func Trace(args ...interface{}) { Default().Trace(args...) }
+func Debug(args ...interface{}) { Default().Debug(args...) }
+func Info(args ...interface{})  { Default().Info(args...) }
+func Warn(args ...interface{})  { Default().Warn(args...) }
+func Error(args ...interface{}) { Default().Error(args...) }
+
+func Tracef(format string, args ...interface{}) { Default().Tracef(format, args...) }
+func Debugf(format string, args ...interface{}) { Default().Debugf(format, args...) }
+func Infof(format string, args ...interface{})  { Default().Infof(format, args...) }
+func Warnf(format string, args ...interface{})  { Default().Warnf(format, args...) }
+func Errorf(format string, args ...interface{}) { Default().Errorf(format, args...) }
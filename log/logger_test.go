@@ -0,0 +1,36 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSONLineEncodesNumbersUnquoted(t *testing.T) {
+	var buf bytes.Buffer
+	writeJSONLine(&buf, InfoLevel, "stabilize tick", []interface{}{
+		"latencyMs", 42,
+		"fingerIndex", 7,
+		"ok", true,
+		"remoteAddr", "10.0.0.1:1",
+		"err", errors.New("boom"),
+	})
+
+	line := buf.String()
+	if !strings.Contains(line, `"latencyMs":42`) {
+		t.Errorf("expected latencyMs to be an unquoted JSON number, got: %s", line)
+	}
+	if !strings.Contains(line, `"fingerIndex":7`) {
+		t.Errorf("expected fingerIndex to be an unquoted JSON number, got: %s", line)
+	}
+	if !strings.Contains(line, `"ok":true`) {
+		t.Errorf("expected ok to be an unquoted JSON bool, got: %s", line)
+	}
+	if !strings.Contains(line, `"remoteAddr":"10.0.0.1:1"`) {
+		t.Errorf("expected remoteAddr to remain a quoted JSON string, got: %s", line)
+	}
+	if !strings.Contains(line, `"err":"boom"`) {
+		t.Errorf("expected err to render via Error() as a quoted string, got: %s", line)
+	}
+}
@@ -2,6 +2,7 @@ package chord
 
 import (
 	"errors"
+	"os"
 	"sync"
 	"time"
 
@@ -10,10 +11,19 @@ import (
 	"github.com/nknorg/nnet/log"
 	"github.com/nknorg/nnet/node"
 	"github.com/nknorg/nnet/overlay"
+	"github.com/nknorg/nnet/overlay/chord/transport"
 	"github.com/nknorg/nnet/overlay/routing"
 	"github.com/nknorg/nnet/protobuf"
 )
 
+// secureRemoteConn is implemented by transport.SecureConn. Checking for it
+// with a type assertion, rather than importing node's internal connection
+// type, lets the plaintext fallback path (config.Config.SecureTransport ==
+// false) skip ID verification entirely.
+type secureRemoteConn interface {
+	RemoteID() [transport.IDSize]byte
+}
+
 const (
 	// How many concurrent goroutines are handling messages
 	numWorkers = 1
@@ -29,6 +39,12 @@ type Chord struct {
 	fingerTable           []*NeighborList
 	neighbors             *NeighborList
 	*middlewareStore
+	peerScoreState
+	lookupRateLimiterState
+	relayState
+	secureState
+	secureTransport bool
+	logger          log.Logger
 }
 
 // NewChord creates a Chord overlay network
@@ -70,6 +86,20 @@ func NewChord(localNode *node.LocalNode, conf *config.Config) (*Chord, error) {
 
 	middlewareStore := newMiddlewareStore()
 
+	logBackend := log.TextBackend
+	if conf.LogFormat == "json" {
+		logBackend = log.JSONBackend
+	}
+	chordLogger := log.New(logBackend, os.Stderr, log.InfoLevel).With("localID", encodeHexID(localNode.Id))
+
+	secureConfig := transport.DefaultSecureConfig()
+	if conf.SecureTransport {
+		secureConfig.StaticKey, err = transport.NewStaticKeyPair()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	c := &Chord{
 		Overlay:               ovl,
 		nodeIDBits:            nodeIDBits,
@@ -79,6 +109,15 @@ func NewChord(localNode *node.LocalNode, conf *config.Config) (*Chord, error) {
 		fingerTable:           fingerTable,
 		neighbors:             neighbors,
 		middlewareStore:       middlewareStore,
+		peerScoreState:        peerScoreState{maxPeerErrors: conf.MaxPeerErrors},
+		lookupRateLimiterState: lookupRateLimiterState{
+			lookupBucketSize:        orDefaultFloat(conf.LookupRateLimitBurst, defaultLookupBucketSize),
+			lookupRefillPerSec:      orDefaultFloat(conf.LookupRateLimitPerSec, defaultLookupRefillPerSec),
+			lookupBucketIdleTimeout: conf.LookupRateLimitIdleTimeout,
+		},
+		secureState:     secureState{secureConfig: secureConfig},
+		secureTransport: conf.SecureTransport,
+		logger:          chordLogger,
 	}
 
 	directRxMsgChan, err := localNode.GetRxMsgChan(protobuf.DIRECT)
@@ -98,7 +137,11 @@ func NewChord(localNode *node.LocalNode, conf *config.Config) (*Chord, error) {
 	if err != nil {
 		return nil, err
 	}
-	relayRouting, err := NewRelayRouting(ovl.LocalMsgChan, relayRxMsgChan, c)
+	// shouldDropLookup also has to run here, ahead of the relay router's
+	// per-hop forwarding decision, since a lookup this node only forwards
+	// toward its target never reaches handleMsg's LocalMsgChan check.
+	rateLimitedRelayRxMsgChan := c.filterRelayRxLookups(relayRxMsgChan)
+	relayRouting, err := NewRelayRouting(ovl.LocalMsgChan, rateLimitedRelayRxMsgChan, c)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +164,38 @@ func NewChord(localNode *node.LocalNode, conf *config.Config) (*Chord, error) {
 	}
 
 	err = localNode.ApplyMiddleware(node.RemoteNodeReady(func(rn *node.RemoteNode) bool {
+		// An evicted peer stays off the neighbor lists for
+		// defaultPeerErrorBackoff instead of being re-admitted the moment it
+		// reconnects.
+		if c.isBackingOff(rn.Id) {
+			rn.Stop(nil)
+			return false
+		}
+
+		if c.secureTransport {
+			handshakeLogger := c.logger.With("subsys", "handshake", "remoteAddr", rn.Addr)
+
+			secureConn, err := c.upgradeConn(rn)
+			if err != nil {
+				handshakeLogger.With("errClass", "handshake").Errorf("Noise-IK handshake with %x failed, rejecting: %v", rn.Id, err)
+				rn.Stop(err)
+				return false
+			}
+			if secureConn != nil {
+				rn.Conn = secureConn
+				c.rememberStaticKey(secureConn.RemoteID(), secureConn.RemoteStatic())
+			}
+
+			if sc, ok := rn.Conn.(secureRemoteConn); ok {
+				remoteID := sc.RemoteID()
+				if CompareID(rn.Id, remoteID[:c.nodeIDBits/8]) != 0 {
+					handshakeLogger.With("remoteID", encodeHexID(rn.Id), "errClass", "idMismatch").Error(transport.ErrIDMismatch)
+					rn.Stop(transport.ErrIDMismatch)
+					return false
+				}
+			}
+		}
+
 		c.addRemoteNode(rn)
 		return true
 	}))
@@ -130,6 +205,7 @@ func NewChord(localNode *node.LocalNode, conf *config.Config) (*Chord, error) {
 
 	err = localNode.ApplyMiddleware(node.RemoteNodeDisconnected(func(rn *node.RemoteNode) bool {
 		c.removeNeighbor(rn)
+		c.revokeRelayReservation(rn)
 		return true
 	}))
 	if err != nil {
@@ -144,20 +220,22 @@ func (c *Chord) Start() error {
 	c.StartOnce.Do(func() {
 		var joinOnce sync.Once
 
+		joinLogger := c.logger.With("subsys", "join")
+
 		err := c.ApplyMiddleware(SuccessorAdded(func(remoteNode *node.RemoteNode, index int) bool {
 			joinOnce.Do(func() {
 				// prev is used to prevent msg being routed to self
 				prev := prevID(c.LocalNode.Id, c.nodeIDBits)
 				succs, err := c.FindSuccessors(prev, c.successors.Cap())
 				if err != nil {
-					log.Error("Join failed:", err)
+					joinLogger.With("rpc", "FindSuccessors", "errClass", "join").Error(err)
 				}
 
 				for _, succ := range succs {
 					if CompareID(succ.Id, c.LocalNode.Id) != 0 {
 						err = c.Connect(succ.Addr, succ.Id)
 						if err != nil {
-							log.Error(err)
+							joinLogger.With("remoteID", encodeHexID(succ.Id), "remoteAddr", succ.Addr, "errClass", "join").Error(err)
 						}
 					}
 				}
@@ -174,6 +252,9 @@ func (c *Chord) Start() error {
 			go c.handleMsg()
 		}
 
+		go c.sweepRateLimiter()
+		go c.sweepPeerScores()
+
 		err = c.StartRouters()
 		if err != nil {
 			c.Stop(err)
@@ -187,9 +268,9 @@ func (c *Chord) Start() error {
 func (c *Chord) Stop(err error) {
 	c.StopOnce.Do(func() {
 		if err != nil {
-			log.Warnf("Chord overlay stops because of error: %s", err)
+			c.logger.With("errClass", "stop").Warnf("Chord overlay stops because of error: %s", err)
 		} else {
-			log.Infof("Chord overlay stops")
+			c.logger.Infof("Chord overlay stops")
 		}
 
 		c.LifeCycle.Stop()
@@ -208,6 +289,8 @@ func (c *Chord) Join(seedNodeAddr string) error {
 
 // handleMsg starts a loop that handles received msg
 func (c *Chord) handleMsg() {
+	msgLogger := c.logger.With("subsys", "handleMsg")
+
 	var remoteMsg *node.RemoteMessage
 	var shouldLocalNodeHandleMsg bool
 	var err error
@@ -219,22 +302,52 @@ func (c *Chord) handleMsg() {
 
 		remoteMsg = <-c.LocalMsgChan
 
+		// A message relayed in and delivered locally already cleared the
+		// rate limiter in filterRelayRxLookups; checking it again here
+		// would charge the same physical message against its bucket twice.
+		if !c.consumeRelayPassed(remoteMsg) && c.shouldDropLookup(remoteMsg) {
+			continue
+		}
+
+		if handled, err := c.dispatchRelayControlMsg(remoteMsg); handled {
+			if err != nil {
+				msgLogger.With("remoteID", remoteMsgRemoteID(remoteMsg), "remoteAddr", remoteMsgRemoteAddr(remoteMsg), "errClass", "relay").Error(err)
+			}
+			continue
+		}
+
 		shouldLocalNodeHandleMsg, err = c.handleRemoteMessage(remoteMsg)
 		if err != nil {
-			log.Error(err)
+			msgLogger.With("remoteID", remoteMsgRemoteID(remoteMsg), "remoteAddr", remoteMsgRemoteAddr(remoteMsg), "errClass", "handle").Error(err)
 			continue
 		}
 
 		if shouldLocalNodeHandleMsg {
 			err = c.LocalNode.HandleRemoteMessage(remoteMsg)
 			if err != nil {
-				log.Error(err)
+				msgLogger.With("remoteID", remoteMsgRemoteID(remoteMsg), "remoteAddr", remoteMsgRemoteAddr(remoteMsg), "errClass", "handle").Error(err)
 				continue
 			}
 		}
 	}
 }
 
+// remoteMsgRemoteID and remoteMsgRemoteAddr pull logging context out of a
+// RemoteMessage, tolerating a nil RemoteNode for locally-originated messages.
+func remoteMsgRemoteID(remoteMsg *node.RemoteMessage) string {
+	if remoteMsg == nil || remoteMsg.RemoteNode == nil {
+		return ""
+	}
+	return encodeHexID(remoteMsg.RemoteNode.Id)
+}
+
+func remoteMsgRemoteAddr(remoteMsg *node.RemoteMessage) string {
+	if remoteMsg == nil || remoteMsg.RemoteNode == nil {
+		return ""
+	}
+	return remoteMsg.RemoteNode.Addr
+}
+
 // stabilize periodically updates successors and fingerTable to keep topology
 // correct
 func (c *Chord) stabilize() {
@@ -243,10 +356,13 @@ func (c *Chord) stabilize() {
 	go c.updateFinger()
 	go c.findNewPredecessors()
 	go c.findNewFinger()
+	go c.refreshRelayReservations()
 }
 
 // updateSuccessors periodically updates successors
 func (c *Chord) updateSuccessors() {
+	subLogger := c.logger.With("subsys", "successor")
+
 	var err error
 
 	for {
@@ -256,15 +372,18 @@ func (c *Chord) updateSuccessors() {
 
 		time.Sleep(randDuration(c.baseStabilizeInterval))
 
+		start := time.Now()
 		err = c.updateNeighborList(c.successors)
 		if err != nil {
-			log.Error("Update successors error:", err)
+			subLogger.With("rpc", "updateNeighborList", "latencyMs", time.Since(start).Milliseconds(), "errClass", "update").Error(err)
 		}
 	}
 }
 
 // updatePredecessors periodically updates predecessors
 func (c *Chord) updatePredecessors() {
+	subLogger := c.logger.With("subsys", "predecessor")
+
 	var err error
 
 	for {
@@ -274,15 +393,18 @@ func (c *Chord) updatePredecessors() {
 
 		time.Sleep(3 * randDuration(c.baseStabilizeInterval))
 
+		start := time.Now()
 		err = c.updateNeighborList(c.predecessors)
 		if err != nil {
-			log.Error("Update predecessor error:", err)
+			subLogger.With("rpc", "updateNeighborList", "latencyMs", time.Since(start).Milliseconds(), "errClass", "update").Error(err)
 		}
 	}
 }
 
 // findNewPredecessors periodically find new predecessors
 func (c *Chord) findNewPredecessors() {
+	subLogger := c.logger.With("subsys", "predecessor")
+
 	var err error
 	var existing *node.RemoteNode
 	var maybeNewNodes []*protobuf.Node
@@ -294,19 +416,21 @@ func (c *Chord) findNewPredecessors() {
 
 		time.Sleep(3 * randDuration(c.baseStabilizeInterval))
 
+		start := time.Now()
 		maybeNewNodes, err = c.FindPredecessors(c.predecessors.startID, 1)
 		if err != nil {
-			log.Error("Find predecessors error:", err)
+			subLogger.With("rpc", "FindPredecessors", "latencyMs", time.Since(start).Milliseconds(), "errClass", "find").Error(err)
 			continue
 		}
 
 		for _, n := range maybeNewNodes {
 			if c.predecessors.IsIDInRange(n.Id) && !c.predecessors.Exists(n.Id) {
 				existing = c.predecessors.GetFirst()
-				if existing == nil || c.predecessors.cmp(n, existing.Node.Node) < 0 {
+				if existing == nil || c.preferByScore(n, existing.Node.Node, c.predecessors.cmp) {
 					err = c.Connect(n.Addr, n.Id)
 					if err != nil {
-						log.Error("Connect to new predecessor error:", err)
+						subLogger.With("rpc", "Connect", "remoteID", encodeHexID(n.Id), "remoteAddr", n.Addr, "errClass", "connect").Error(err)
+						c.recordPeerError(n.Id, nil, "connect")
 					}
 				}
 			}
@@ -316,11 +440,12 @@ func (c *Chord) findNewPredecessors() {
 
 // updateSuccAndPred periodically updates non-empty finger table items
 func (c *Chord) updateFinger() {
+	subLogger := c.logger.With("subsys", "finger")
+
 	var err error
-	var finger *NeighborList
 
 	for {
-		for _, finger = range c.fingerTable {
+		for i, finger := range c.fingerTable {
 			if finger.IsEmpty() {
 				continue
 			}
@@ -331,9 +456,10 @@ func (c *Chord) updateFinger() {
 
 			time.Sleep(randDuration(c.baseStabilizeInterval))
 
+			start := time.Now()
 			err = c.updateNeighborList(finger)
 			if err != nil {
-				log.Error("Update finger table error:", err)
+				subLogger.With("fingerIndex", i, "rpc", "updateNeighborList", "latencyMs", time.Since(start).Milliseconds(), "errClass", "update").Error(err)
 			}
 		}
 
@@ -344,6 +470,8 @@ func (c *Chord) updateFinger() {
 
 // updateSuccAndPred periodically updates empty finger table items
 func (c *Chord) findNewFinger() {
+	subLogger := c.logger.With("subsys", "finger")
+
 	var err error
 	var i int
 	var existing *node.RemoteNode
@@ -357,9 +485,10 @@ func (c *Chord) findNewFinger() {
 
 			time.Sleep(randDuration(c.baseStabilizeInterval))
 
+			start := time.Now()
 			succs, err = c.FindSuccessors(c.fingerTable[i].startID, 1)
 			if err != nil {
-				log.Error("Find successor for finger table error:", err)
+				subLogger.With("fingerIndex", i, "rpc", "FindSuccessors", "latencyMs", time.Since(start).Milliseconds(), "errClass", "find").Error(err)
 				continue
 			}
 
@@ -370,10 +499,11 @@ func (c *Chord) findNewFinger() {
 			for i < len(c.fingerTable) {
 				if c.fingerTable[i].IsIDInRange(succs[0].Id) && !c.fingerTable[i].Exists(succs[0].Id) {
 					existing = c.fingerTable[i].GetFirst()
-					if existing == nil || c.fingerTable[i].cmp(succs[0], existing.Node.Node) < 0 {
+					if existing == nil || c.preferByScore(succs[0], existing.Node.Node, c.fingerTable[i].cmp) {
 						err = c.Connect(succs[0].Addr, succs[0].Id)
 						if err != nil {
-							log.Error("Connect to new successor error:", err)
+							subLogger.With("fingerIndex", i, "rpc", "Connect", "remoteID", encodeHexID(succs[0].Id), "remoteAddr", succs[0].Addr, "errClass", "connect").Error(err)
+							c.recordPeerError(succs[0].Id, nil, "connect")
 						}
 					}
 					break
@@ -386,7 +516,7 @@ func (c *Chord) findNewFinger() {
 
 // GetSuccAndPred sends a GetSuccAndPred message to remote node and returns its
 // successors and predecessor if no error occured
-func GetSuccAndPred(remoteNode *node.RemoteNode, numSucc, numPred uint32) ([]*protobuf.Node, []*protobuf.Node, error) {
+func (c *Chord) GetSuccAndPred(remoteNode *node.RemoteNode, numSucc, numPred uint32) ([]*protobuf.Node, []*protobuf.Node, error) {
 	msg, err := NewGetSuccAndPredMessage(numSucc, numPred)
 	if err != nil {
 		return nil, nil, err
@@ -394,15 +524,19 @@ func GetSuccAndPred(remoteNode *node.RemoteNode, numSucc, numPred uint32) ([]*pr
 
 	reply, err := remoteNode.SendMessageSync(msg)
 	if err != nil {
+		c.recordPeerError(remoteNode.Id, remoteNode, "timeout")
 		return nil, nil, err
 	}
 
 	replyBody := &protobuf.GetSuccAndPredReply{}
 	err = proto.Unmarshal(reply.Msg.Message, replyBody)
 	if err != nil {
+		c.recordPeerError(remoteNode.Id, remoteNode, "malformed")
 		return nil, nil, err
 	}
 
+	c.recordPeerSuccess(remoteNode)
+
 	return replyBody.Successors, replyBody.Predecessors, nil
 }
 
@@ -434,17 +568,23 @@ func (c *Chord) FindSuccessors(key []byte, numSucc uint32) ([]*protobuf.Node, er
 		return nil, err
 	}
 
-	reply, _, err := c.SendMessageSync(msg, protobuf.RELAY)
+	reply, remoteNode, err := c.SendMessageSync(msg, protobuf.RELAY)
 	if err != nil {
+		if remoteNode != nil {
+			c.recordPeerError(remoteNode.Id, remoteNode, "timeout")
+		}
 		return nil, err
 	}
 
 	replyBody := &protobuf.FindSuccessorsReply{}
 	err = proto.Unmarshal(reply.Message, replyBody)
 	if err != nil {
+		c.recordPeerError(remoteNode.Id, remoteNode, "malformed")
 		return nil, err
 	}
 
+	c.recordPeerSuccess(remoteNode)
+
 	if len(replyBody.Successors) > int(numSucc) {
 		return replyBody.Successors[:numSucc], nil
 	}
@@ -476,17 +616,23 @@ func (c *Chord) FindPredecessors(key []byte, numPred uint32) ([]*protobuf.Node,
 		return nil, err
 	}
 
-	reply, _, err := c.SendMessageSync(msg, protobuf.RELAY)
+	reply, remoteNode, err := c.SendMessageSync(msg, protobuf.RELAY)
 	if err != nil {
+		if remoteNode != nil {
+			c.recordPeerError(remoteNode.Id, remoteNode, "timeout")
+		}
 		return nil, err
 	}
 
 	replyBody := &protobuf.FindPredecessorsReply{}
 	err = proto.Unmarshal(reply.Message, replyBody)
 	if err != nil {
+		c.recordPeerError(remoteNode.Id, remoteNode, "malformed")
 		return nil, err
 	}
 
+	c.recordPeerSuccess(remoteNode)
+
 	if len(replyBody.Predecessors) > int(numPred) {
 		return replyBody.Predecessors[:numPred], nil
 	}
@@ -0,0 +1,256 @@
+package chord
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nknorg/nnet/node"
+	"github.com/nknorg/nnet/protobuf"
+)
+
+const (
+	// defaultPeerErrorBackoff is how long a node is turned away by the
+	// RemoteNodeReady middleware, before it reaches addRemoteNode, after
+	// being evicted for crossing MaxPeerErrors.
+	defaultPeerErrorBackoff = 5 * time.Minute
+
+	// peerScoreIdleTimeout is how long a peerScores entry can sit unused
+	// before the sweeper reclaims it, mirroring the rate limiter's idle
+	// bucket sweep. Without this, a long-running, high-churn node's map
+	// grows by one entry for every distinct peer ID it has ever scored,
+	// since only eviction removes an entry and most peers disconnect
+	// normally without ever crossing MaxPeerErrors.
+	peerScoreIdleTimeout = 10 * time.Minute
+
+	// peerScoreSweepInterval is how often the sweeper goroutine scans for
+	// idle peerScores entries.
+	peerScoreSweepInterval = time.Minute
+)
+
+// PeerScoreChanged is called after a remote node's peer error score changes,
+// either because an error was recorded against it or because it decayed
+// after a successful RPC.
+type PeerScoreChanged func(remoteNode *node.RemoteNode, score int) bool
+
+// PeerEvicted is called after a remote node has been removed from every
+// NeighborList because its error score crossed MaxPeerErrors.
+type PeerEvicted func(remoteNode *node.RemoteNode) bool
+
+// peerScore is the running error count for a single remote node, keyed by
+// its raw Chord ID.
+type peerScore struct {
+	errors   int
+	lastUsed time.Time
+}
+
+// recordPeerError increments the error score for id by one, runs
+// PeerScoreChanged, and evicts rn once the score crosses MaxPeerErrors.
+// errClass is a short machine-readable reason ("timeout", "malformed",
+// "connect") used by PeerScoreChanged subscribers for telemetry. rn may be
+// nil when the error happened before a RemoteNode was established (e.g. a
+// Connect failure while probing a candidate finger/predecessor), in which
+// case no middleware runs and no connection is stopped; the score, the
+// NeighborLists and the backoff list are still updated.
+func (c *Chord) recordPeerError(id []byte, rn *node.RemoteNode, errClass string) {
+	if len(id) == 0 {
+		return
+	}
+
+	key := string(id)
+
+	c.peerScoreLock.Lock()
+	if c.peerScores == nil {
+		c.peerScores = make(map[string]*peerScore)
+	}
+	ps, ok := c.peerScores[key]
+	if !ok {
+		ps = &peerScore{}
+		c.peerScores[key] = ps
+	}
+	ps.errors++
+	ps.lastUsed = time.Now()
+	score := ps.errors
+	evict := c.maxPeerErrors > 0 && score >= c.maxPeerErrors
+	c.peerScoreLock.Unlock()
+
+	if rn != nil {
+		c.runPeerScoreChanged(rn, score)
+	}
+
+	if evict {
+		c.evictPeer(id, rn, errClass)
+	}
+}
+
+// recordPeerSuccess decays rn's error score by one after a successful RPC.
+func (c *Chord) recordPeerSuccess(rn *node.RemoteNode) {
+	if rn == nil || len(rn.Id) == 0 {
+		return
+	}
+
+	key := string(rn.Id)
+
+	c.peerScoreLock.Lock()
+	ps, ok := c.peerScores[key]
+	if !ok || ps.errors == 0 {
+		c.peerScoreLock.Unlock()
+		return
+	}
+	ps.errors--
+	ps.lastUsed = time.Now()
+	score := ps.errors
+	c.peerScoreLock.Unlock()
+
+	c.runPeerScoreChanged(rn, score)
+}
+
+// isBackingOff reports whether id is currently serving out a post-eviction
+// backoff period and should not be re-admitted by addRemoteNode.
+func (c *Chord) isBackingOff(id []byte) bool {
+	c.peerScoreLock.Lock()
+	defer c.peerScoreLock.Unlock()
+
+	until, ok := c.peerBackoff[string(id)]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(c.peerBackoff, string(id))
+		return false
+	}
+	return true
+}
+
+// sweepPeerScores periodically evicts peerScores entries that have been
+// idle for longer than peerScoreIdleTimeout, so a long-running node's score
+// map does not grow without bound as peers it has scored come and go
+// without ever crossing MaxPeerErrors.
+func (c *Chord) sweepPeerScores() {
+	for {
+		if c.IsStopped() {
+			return
+		}
+
+		time.Sleep(peerScoreSweepInterval)
+
+		cutoff := time.Now().Add(-peerScoreIdleTimeout)
+
+		c.peerScoreLock.Lock()
+		for k, ps := range c.peerScores {
+			if ps.lastUsed.Before(cutoff) {
+				delete(c.peerScores, k)
+			}
+		}
+		c.peerScoreLock.Unlock()
+	}
+}
+
+// evictPeer removes id from every NeighborList, disconnects rn if known, and
+// places id on the backoff list that the RemoteNodeReady middleware checks
+// before calling addRemoteNode.
+func (c *Chord) evictPeer(id []byte, rn *node.RemoteNode, errClass string) {
+	c.successors.Remove(id)
+	c.predecessors.Remove(id)
+	for _, finger := range c.fingerTable {
+		finger.Remove(id)
+	}
+	c.neighbors.Remove(id)
+
+	c.peerScoreLock.Lock()
+	if c.peerBackoff == nil {
+		c.peerBackoff = make(map[string]time.Time)
+	}
+	c.peerBackoff[string(id)] = time.Now().Add(defaultPeerErrorBackoff)
+	delete(c.peerScores, string(id))
+	c.peerScoreLock.Unlock()
+
+	if rn != nil {
+		rn.Stop(nil)
+		c.runPeerEvicted(rn)
+	}
+}
+
+// preferByScore reports whether candidate should be preferred over existing
+// when both are otherwise comparable, based on accumulated peer error score.
+// Lower score wins; a tie is broken by cmp, the list's existing ID-distance
+// comparator.
+func (c *Chord) preferByScore(candidate, existing *protobuf.Node, cmp func(a, b *protobuf.Node) int) bool {
+	if c == nil || candidate == nil || existing == nil {
+		return cmp(candidate, existing) < 0
+	}
+
+	c.peerScoreLock.Lock()
+	candScore := 0
+	if ps, ok := c.peerScores[string(candidate.Id)]; ok {
+		candScore = ps.errors
+	}
+	existScore := 0
+	if ps, ok := c.peerScores[string(existing.Id)]; ok {
+		existScore = ps.errors
+	}
+	c.peerScoreLock.Unlock()
+
+	if candScore != existScore {
+		return candScore < existScore
+	}
+
+	return cmp(candidate, existing) < 0
+}
+
+// runPeerScoreChanged invokes every registered PeerScoreChanged middleware.
+func (c *Chord) runPeerScoreChanged(rn *node.RemoteNode, score int) {
+	c.peerMiddlewareLock.RLock()
+	handlers := c.peerScoreChanged
+	c.peerMiddlewareLock.RUnlock()
+
+	for _, h := range handlers {
+		if !h(rn, score) {
+			return
+		}
+	}
+}
+
+// runPeerEvicted invokes every registered PeerEvicted middleware.
+func (c *Chord) runPeerEvicted(rn *node.RemoteNode) {
+	c.peerMiddlewareLock.RLock()
+	handlers := c.peerEvicted
+	c.peerMiddlewareLock.RUnlock()
+
+	for _, h := range handlers {
+		if !h(rn) {
+			return
+		}
+	}
+}
+
+// ApplyPeerScoreChanged registers m to be called whenever a remote node's
+// peer error score changes.
+func (c *Chord) ApplyPeerScoreChanged(m PeerScoreChanged) {
+	c.peerMiddlewareLock.Lock()
+	c.peerScoreChanged = append(c.peerScoreChanged, m)
+	c.peerMiddlewareLock.Unlock()
+}
+
+// ApplyPeerEvicted registers m to be called whenever a remote node is
+// evicted from all NeighborLists for crossing MaxPeerErrors.
+func (c *Chord) ApplyPeerEvicted(m PeerEvicted) {
+	c.peerMiddlewareLock.Lock()
+	c.peerEvicted = append(c.peerEvicted, m)
+	c.peerMiddlewareLock.Unlock()
+}
+
+// peerScoreState holds the bookkeeping recordPeerError/recordPeerSuccess and
+// the PeerScoreChanged/PeerEvicted middlewares operate on. It is embedded
+// into Chord rather than middlewareStore so it can carry its own lock
+// separate from the existing middleware dispatch.
+type peerScoreState struct {
+	maxPeerErrors int
+
+	peerScoreLock sync.Mutex
+	peerScores    map[string]*peerScore
+	peerBackoff   map[string]time.Time
+
+	peerMiddlewareLock sync.RWMutex
+	peerScoreChanged   []PeerScoreChanged
+	peerEvicted        []PeerEvicted
+}
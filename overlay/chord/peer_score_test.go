@@ -0,0 +1,99 @@
+package chord
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nknorg/nnet/node"
+	"github.com/nknorg/nnet/protobuf"
+)
+
+func TestRecordPeerErrorAndSuccess(t *testing.T) {
+	c := &Chord{peerScoreState: peerScoreState{maxPeerErrors: 0}}
+
+	id := []byte("peer-a")
+	c.recordPeerError(id, nil, "timeout")
+	c.recordPeerError(id, nil, "timeout")
+
+	c.peerScoreLock.Lock()
+	score := c.peerScores[string(id)].errors
+	c.peerScoreLock.Unlock()
+	if score != 2 {
+		t.Fatalf("score after two errors = %d, want 2", score)
+	}
+
+	c.recordPeerSuccess(&node.RemoteNode{Id: id})
+
+	c.peerScoreLock.Lock()
+	score = c.peerScores[string(id)].errors
+	c.peerScoreLock.Unlock()
+	if score != 1 {
+		t.Fatalf("score after one success = %d, want 1", score)
+	}
+}
+
+func TestIsBackingOff(t *testing.T) {
+	c := &Chord{}
+	id := []byte("peer-b")
+
+	if c.isBackingOff(id) {
+		t.Fatalf("a peer with no backoff entry should not be backing off")
+	}
+
+	c.peerScoreLock.Lock()
+	c.peerBackoff = map[string]time.Time{string(id): time.Now().Add(time.Minute)}
+	c.peerScoreLock.Unlock()
+
+	if !c.isBackingOff(id) {
+		t.Fatalf("a peer within its backoff window should be backing off")
+	}
+
+	c.peerScoreLock.Lock()
+	c.peerBackoff[string(id)] = time.Now().Add(-time.Second)
+	c.peerScoreLock.Unlock()
+
+	if c.isBackingOff(id) {
+		t.Fatalf("a peer past its backoff window should no longer be backing off")
+	}
+
+	c.peerScoreLock.Lock()
+	_, stillPresent := c.peerBackoff[string(id)]
+	c.peerScoreLock.Unlock()
+	if stillPresent {
+		t.Fatalf("an expired backoff entry should be removed from the map")
+	}
+}
+
+func TestPreferByScore(t *testing.T) {
+	c := &Chord{}
+	cmp := func(a, b *protobuf.Node) int {
+		if len(a.Id) < len(b.Id) {
+			return -1
+		}
+		if len(a.Id) > len(b.Id) {
+			return 1
+		}
+		return 0
+	}
+
+	candidate := &protobuf.Node{Id: []byte("cand")}
+	existing := &protobuf.Node{Id: []byte("exist")}
+
+	c.peerScoreLock.Lock()
+	c.peerScores = map[string]*peerScore{
+		string(existing.Id): {errors: 3},
+	}
+	c.peerScoreLock.Unlock()
+
+	if !c.preferByScore(candidate, existing, cmp) {
+		t.Fatalf("a candidate with a lower error score should be preferred")
+	}
+
+	c.peerScoreLock.Lock()
+	c.peerScores[string(candidate.Id)] = &peerScore{errors: 3}
+	c.peerScoreLock.Unlock()
+
+	if !c.preferByScore(candidate, existing, cmp) {
+		t.Fatalf("a tied score should fall back to cmp, which prefers the shorter ID")
+	}
+}
@@ -0,0 +1,268 @@
+package chord
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nknorg/nnet/node"
+	"github.com/nknorg/nnet/protobuf"
+)
+
+const (
+	// defaultLookupBucketSize is the default token-bucket burst size applied
+	// to FindSuccessors/FindPredecessors/GetSuccAndPred when config.Config
+	// does not override it.
+	defaultLookupBucketSize = 10
+
+	// defaultLookupRefillPerSec is the default token-bucket refill rate.
+	defaultLookupRefillPerSec = 1.0
+
+	// defaultLookupBucketIdleTimeout is how long a per-ID or per-address
+	// bucket can sit unused before the sweeper reclaims it.
+	defaultLookupBucketIdleTimeout = 10 * time.Minute
+
+	// lookupBucketSweepInterval is how often the sweeper goroutine scans
+	// for idle buckets.
+	lookupBucketSweepInterval = time.Minute
+
+	// relayPassedTTL bounds how long a message can sit in relayPassed
+	// before the sweeper reclaims the entry. Messages normally drain from
+	// LocalMsgChan within milliseconds of being admitted, so this only
+	// matters for the relay-rx messages that get forwarded on rather than
+	// delivered locally and therefore never reach handleMsg to consume
+	// their own entry.
+	relayPassedTTL = 30 * time.Second
+)
+
+// orDefaultFloat returns v unless it is zero, in which case it returns def.
+// It lets a zero-value config.Config (as used throughout nnet's tests) fall
+// back to sane limiter defaults instead of a bucket that never refills.
+func orDefaultFloat(v float64, def float64) float64 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// isLookupMessageType reports whether t is one of the expensive lookup
+// message types the rate limiter guards.
+func isLookupMessageType(t protobuf.MessageType) bool {
+	switch t {
+	case protobuf.FIND_SUCCESSORS, protobuf.FIND_PREDECESSORS, protobuf.GET_SUCC_AND_PRED:
+		return true
+	default:
+		return false
+	}
+}
+
+// tokenBucket is a simple token-bucket limiter, refilled lazily on allow.
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	lastUsed   time.Time
+}
+
+// allow reports whether a token is available, consuming one if so. capacity
+// and refillPerSec parameterize the bucket so the same type can serve both
+// the per-ID and per-address pools with different sizes if ever needed.
+func (b *tokenBucket) allow(now time.Time, capacity, refillPerSec float64) bool {
+	if b.lastRefill.IsZero() {
+		b.tokens = capacity
+	} else {
+		elapsed := now.Sub(b.lastRefill).Seconds()
+		b.tokens += elapsed * refillPerSec
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+	}
+	b.lastRefill = now
+	b.lastUsed = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// lookupRateLimiterState holds the per-ID and per-address token buckets
+// guarding expensive lookup RPCs, plus the knobs controlling them. It is
+// embedded into Chord rather than middlewareStore so it can carry its own
+// lock separate from the existing middleware dispatch.
+type lookupRateLimiterState struct {
+	lookupBucketSize        float64
+	lookupRefillPerSec      float64
+	lookupBucketIdleTimeout time.Duration
+
+	rateLimiterLock sync.Mutex
+	byID            map[string]*tokenBucket
+	byAddr          map[string]*tokenBucket
+
+	relayPassedLock sync.Mutex
+	relayPassed     map[*node.RemoteMessage]time.Time
+
+	rateLimitMiddlewareLock sync.RWMutex
+	lookupRateLimited       []LookupRateLimited
+}
+
+// LookupRateLimited is called whenever a lookup message is dropped because
+// its per-ID or per-address bucket was empty.
+type LookupRateLimited func(remoteNode *node.RemoteNode, msgType protobuf.MessageType) bool
+
+// ApplyLookupRateLimited registers m to be called whenever a lookup message
+// is dropped by the rate limiter.
+func (c *Chord) ApplyLookupRateLimited(m LookupRateLimited) {
+	c.rateLimitMiddlewareLock.Lock()
+	c.lookupRateLimited = append(c.lookupRateLimited, m)
+	c.rateLimitMiddlewareLock.Unlock()
+}
+
+func (c *Chord) runLookupRateLimited(rn *node.RemoteNode, msgType protobuf.MessageType) {
+	c.rateLimitMiddlewareLock.RLock()
+	handlers := c.lookupRateLimited
+	c.rateLimitMiddlewareLock.RUnlock()
+
+	for _, h := range handlers {
+		if !h(rn, msgType) {
+			return
+		}
+	}
+}
+
+// filterRelayRxLookups wraps in with shouldDropLookup so relayed lookup
+// messages that exceed the rate limit never reach the relay router's
+// forwarding decision, not just handleMsg's LocalMsgChan loop. A message
+// that passes is marked in relayPassed so that handleMsg, which also sees
+// every relay-rx message the router decides to deliver locally rather than
+// forward, does not charge the same physical message against the bucket a
+// second time.
+func (c *Chord) filterRelayRxLookups(in <-chan *node.RemoteMessage) <-chan *node.RemoteMessage {
+	out := make(chan *node.RemoteMessage, cap(in))
+	go func() {
+		defer close(out)
+		for remoteMsg := range in {
+			if c.shouldDropLookup(remoteMsg) {
+				continue
+			}
+			c.markRelayPassed(remoteMsg)
+			out <- remoteMsg
+		}
+	}()
+	return out
+}
+
+// markRelayPassed records that remoteMsg already cleared the rate limiter in
+// filterRelayRxLookups.
+func (c *Chord) markRelayPassed(remoteMsg *node.RemoteMessage) {
+	c.relayPassedLock.Lock()
+	if c.relayPassed == nil {
+		c.relayPassed = make(map[*node.RemoteMessage]time.Time)
+	}
+	c.relayPassed[remoteMsg] = time.Now()
+	c.relayPassedLock.Unlock()
+}
+
+// consumeRelayPassed reports whether remoteMsg already cleared the rate
+// limiter via filterRelayRxLookups, removing the entry if so. handleMsg uses
+// this to skip re-running shouldDropLookup on messages the relay filter
+// already accounted for.
+func (c *Chord) consumeRelayPassed(remoteMsg *node.RemoteMessage) bool {
+	c.relayPassedLock.Lock()
+	defer c.relayPassedLock.Unlock()
+	if _, ok := c.relayPassed[remoteMsg]; !ok {
+		return false
+	}
+	delete(c.relayPassed, remoteMsg)
+	return true
+}
+
+// shouldDropLookup reports whether remoteMsg is an expensive lookup message
+// that should be dropped because it exceeds the per-source-ID or
+// per-source-address rate limit. Messages that are not lookups, or that have
+// no RemoteNode attached (i.e. were delivered locally rather than relayed
+// in from the network), are never dropped.
+func (c *Chord) shouldDropLookup(remoteMsg *node.RemoteMessage) bool {
+	if remoteMsg == nil || remoteMsg.Msg == nil || remoteMsg.RemoteNode == nil {
+		return false
+	}
+
+	if !isLookupMessageType(remoteMsg.Msg.MessageType) {
+		return false
+	}
+
+	now := time.Now()
+	idKey := string(remoteMsg.RemoteNode.Id)
+	addrKey := remoteMsg.RemoteNode.Addr
+
+	c.rateLimiterLock.Lock()
+	if c.byID == nil {
+		c.byID = make(map[string]*tokenBucket)
+	}
+	if c.byAddr == nil {
+		c.byAddr = make(map[string]*tokenBucket)
+	}
+
+	idBucket, ok := c.byID[idKey]
+	if !ok {
+		idBucket = &tokenBucket{}
+		c.byID[idKey] = idBucket
+	}
+	addrBucket, ok := c.byAddr[addrKey]
+	if !ok {
+		addrBucket = &tokenBucket{}
+		c.byAddr[addrKey] = addrBucket
+	}
+
+	idAllowed := idBucket.allow(now, c.lookupBucketSize, c.lookupRefillPerSec)
+	addrAllowed := addrBucket.allow(now, c.lookupBucketSize, c.lookupRefillPerSec)
+	c.rateLimiterLock.Unlock()
+
+	if idAllowed && addrAllowed {
+		return false
+	}
+
+	c.runLookupRateLimited(remoteMsg.RemoteNode, remoteMsg.Msg.MessageType)
+	return true
+}
+
+// sweepRateLimiter periodically evicts token buckets that have been idle
+// for longer than lookupBucketIdleTimeout, so a one-off burst of distinct
+// IDs or addresses does not grow the limiter's memory without bound.
+func (c *Chord) sweepRateLimiter() {
+	idleTimeout := c.lookupBucketIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultLookupBucketIdleTimeout
+	}
+
+	for {
+		if c.IsStopped() {
+			return
+		}
+
+		time.Sleep(lookupBucketSweepInterval)
+
+		cutoff := time.Now().Add(-idleTimeout)
+
+		c.rateLimiterLock.Lock()
+		for k, b := range c.byID {
+			if b.lastUsed.Before(cutoff) {
+				delete(c.byID, k)
+			}
+		}
+		for k, b := range c.byAddr {
+			if b.lastUsed.Before(cutoff) {
+				delete(c.byAddr, k)
+			}
+		}
+		c.rateLimiterLock.Unlock()
+
+		relayCutoff := time.Now().Add(-relayPassedTTL)
+		c.relayPassedLock.Lock()
+		for k, t := range c.relayPassed {
+			if t.Before(relayCutoff) {
+				delete(c.relayPassed, k)
+			}
+		}
+		c.relayPassedLock.Unlock()
+	}
+}
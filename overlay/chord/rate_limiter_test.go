@@ -0,0 +1,147 @@
+package chord
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nknorg/nnet/node"
+	"github.com/nknorg/nnet/protobuf"
+)
+
+func TestOrDefaultFloat(t *testing.T) {
+	if got := orDefaultFloat(0, 5); got != 5 {
+		t.Errorf("orDefaultFloat(0, 5) = %v, want 5", got)
+	}
+	if got := orDefaultFloat(3, 5); got != 3 {
+		t.Errorf("orDefaultFloat(3, 5) = %v, want 3", got)
+	}
+}
+
+func TestIsLookupMessageType(t *testing.T) {
+	lookups := []protobuf.MessageType{protobuf.FIND_SUCCESSORS, protobuf.FIND_PREDECESSORS, protobuf.GET_SUCC_AND_PRED}
+	for _, mt := range lookups {
+		if !isLookupMessageType(mt) {
+			t.Errorf("isLookupMessageType(%v) = false, want true", mt)
+		}
+	}
+	if isLookupMessageType(protobuf.RESERVE_RELAY) {
+		t.Errorf("isLookupMessageType(RESERVE_RELAY) = true, want false")
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	var b tokenBucket
+	now := time.Unix(0, 0)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow(now, 3, 1) {
+			t.Fatalf("token %d should be allowed from a full bucket", i)
+		}
+	}
+	if b.allow(now, 3, 1) {
+		t.Fatalf("bucket should be empty after exhausting its burst")
+	}
+
+	later := now.Add(2 * time.Second)
+	if !b.allow(later, 3, 1) {
+		t.Fatalf("bucket should have refilled after 2s at 1/s")
+	}
+}
+
+func TestShouldDropLookupPerID(t *testing.T) {
+	c := &Chord{lookupRateLimiterState: lookupRateLimiterState{
+		lookupBucketSize:   1,
+		lookupRefillPerSec: 0,
+	}}
+
+	remoteMsg := &node.RemoteMessage{
+		Msg:        &protobuf.Message{MessageType: protobuf.FIND_SUCCESSORS},
+		RemoteNode: &node.RemoteNode{Id: []byte("peer-a"), Addr: "10.0.0.1:1"},
+	}
+
+	if c.shouldDropLookup(remoteMsg) {
+		t.Fatalf("first lookup from a fresh bucket should not be dropped")
+	}
+	if !c.shouldDropLookup(remoteMsg) {
+		t.Fatalf("second lookup before any refill should be dropped")
+	}
+}
+
+func TestShouldDropLookupIgnoresNonLookupAndLocalMessages(t *testing.T) {
+	c := &Chord{lookupRateLimiterState: lookupRateLimiterState{lookupBucketSize: 1, lookupRefillPerSec: 0}}
+
+	nonLookup := &node.RemoteMessage{
+		Msg:        &protobuf.Message{MessageType: protobuf.RESERVE_RELAY},
+		RemoteNode: &node.RemoteNode{Id: []byte("peer-a"), Addr: "10.0.0.1:1"},
+	}
+	if c.shouldDropLookup(nonLookup) {
+		t.Fatalf("non-lookup message should never be dropped")
+	}
+
+	local := &node.RemoteMessage{
+		Msg: &protobuf.Message{MessageType: protobuf.FIND_SUCCESSORS},
+	}
+	if c.shouldDropLookup(local) {
+		t.Fatalf("locally-originated message (nil RemoteNode) should never be dropped")
+	}
+}
+
+func TestFilterRelayRxLookupsDropsOverLimitMessages(t *testing.T) {
+	c := &Chord{lookupRateLimiterState: lookupRateLimiterState{lookupBucketSize: 1, lookupRefillPerSec: 0}}
+
+	in := make(chan *node.RemoteMessage, 2)
+	remoteMsg := &node.RemoteMessage{
+		Msg:        &protobuf.Message{MessageType: protobuf.FIND_SUCCESSORS},
+		RemoteNode: &node.RemoteNode{Id: []byte("peer-a"), Addr: "10.0.0.1:1"},
+	}
+	in <- remoteMsg
+	in <- remoteMsg
+	close(in)
+
+	out := c.filterRelayRxLookups(in)
+
+	if _, ok := <-out; !ok {
+		t.Fatalf("first lookup should pass through the filter")
+	}
+
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatalf("second lookup should have been dropped by the rate limiter")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the filter to close out after exhausting in")
+	}
+}
+
+func TestHandleMsgDoesNotDoubleChargeRelayPassedLookups(t *testing.T) {
+	c := &Chord{lookupRateLimiterState: lookupRateLimiterState{lookupBucketSize: 1, lookupRefillPerSec: 0}}
+
+	in := make(chan *node.RemoteMessage, 1)
+	remoteMsg := &node.RemoteMessage{
+		Msg:        &protobuf.Message{MessageType: protobuf.FIND_SUCCESSORS},
+		RemoteNode: &node.RemoteNode{Id: []byte("peer-a"), Addr: "10.0.0.1:1"},
+	}
+	in <- remoteMsg
+	close(in)
+
+	out := c.filterRelayRxLookups(in)
+	if _, ok := <-out; !ok {
+		t.Fatalf("lookup should pass through the filter")
+	}
+
+	if !c.consumeRelayPassed(remoteMsg) {
+		t.Fatalf("message that passed the relay filter should be marked consumable once")
+	}
+	if c.consumeRelayPassed(remoteMsg) {
+		t.Fatalf("consumeRelayPassed should not report the same message twice")
+	}
+
+	// With the bucket already exhausted by the single allowed token above,
+	// a second pass through shouldDropLookup for the same physical message
+	// would incorrectly drop it; consumeRelayPassed lets handleMsg skip
+	// that re-check instead.
+	if c.shouldDropLookup(remoteMsg) != true {
+		t.Fatalf("bucket should be exhausted after the one token the filter consumed")
+	}
+}
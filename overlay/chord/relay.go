@@ -0,0 +1,459 @@
+package chord
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/nknorg/nnet/node"
+	"github.com/nknorg/nnet/protobuf"
+)
+
+func encodeHexID(id []byte) string {
+	return hex.EncodeToString(id)
+}
+
+func decodeHexID(s string) ([]byte, error) {
+	return hex.DecodeString(s)
+}
+
+// newReserveRelayMessage builds the request a NAT'd node sends to one of its
+// successors/fingerTable entries to reserve a relay slot, following the
+// same NewXxxMessage convention as NewGetSuccAndPredMessage and friends.
+func newReserveRelayMessage(localID []byte) (*protobuf.Message, error) {
+	body := &protobuf.ReserveRelay{SrcId: localID}
+
+	buf, err := proto.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protobuf.Message{
+		MessageType: protobuf.RESERVE_RELAY,
+		Message:     buf,
+	}, nil
+}
+
+// newForwardRelayMessage builds the request connectViaRelay sends to an
+// already-connected relay node, asking it to start piping bytes between this
+// connection and the reservation it holds for targetID.
+func newForwardRelayMessage(targetID []byte) (*protobuf.Message, error) {
+	body := &protobuf.ForwardRelay{TargetId: targetID}
+
+	buf, err := proto.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protobuf.Message{
+		MessageType: protobuf.FORWARD_RELAY,
+		Message:     buf,
+	}, nil
+}
+
+const (
+	// relayAddrPrefix marks an address as a relay address of the form
+	// relay://<relayNodeAddr>/<hex targetID>, used by Connect to recognize
+	// that the dial needs to go through an intermediary rather than
+	// directly to targetID.
+	relayAddrPrefix = "relay://"
+
+	// relayReservationTTL is how long a reservation is honored after it was
+	// last refreshed before the relay node reclaims the slot.
+	relayReservationTTL = 3 * time.Minute
+
+	// maxRelayReservationsTotal bounds how many reservations this node will
+	// hold open for other peers at once, across all reserving nodes, to
+	// keep a flood of NAT'd peers from exhausting the relay's connection
+	// table. Reservations are keyed by reserving node ID, so a single
+	// reserving node can only ever occupy one slot regardless of this cap.
+	maxRelayReservationsTotal = 16
+)
+
+// relayAddr is a parsed relay://<relayNodeAddr>/<targetID> address.
+type relayAddr struct {
+	relayNodeAddr string
+	targetID      []byte
+}
+
+// isRelayAddr reports whether addr is a relay address rather than a
+// directly dialable one.
+func isRelayAddr(addr string) bool {
+	return strings.HasPrefix(addr, relayAddrPrefix)
+}
+
+// parseRelayAddr parses a relay://<relayNodeAddr>/<hex targetID> address.
+func parseRelayAddr(addr string) (*relayAddr, error) {
+	rest := strings.TrimPrefix(addr, relayAddrPrefix)
+	idx := strings.LastIndex(rest, "/")
+	if idx < 0 {
+		return nil, errors.New("chord: malformed relay address " + addr)
+	}
+
+	targetID, err := decodeHexID(rest[idx+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &relayAddr{relayNodeAddr: rest[:idx], targetID: targetID}, nil
+}
+
+func formatRelayAddr(relayNodeAddr string, targetID []byte) string {
+	return relayAddrPrefix + relayNodeAddr + "/" + encodeHexID(targetID)
+}
+
+// relayReservation is a live, forwardable connection a relay node is keeping
+// open on behalf of a NAT'd peer that reserved it.
+type relayReservation struct {
+	conn      *node.RemoteNode
+	expiresAt time.Time
+}
+
+// relayState is the relay-side bookkeeping for reservations this node is
+// honoring for other peers, plus the client-side bookkeeping for slots this
+// node has reserved for itself on its own successors/fingerTable.
+type relayState struct {
+	relayLock    sync.Mutex
+	reservations map[string]*relayReservation // keyed by reserving node's ID
+
+	reservedOnLock sync.Mutex
+	reservedOn     map[string]*node.RemoteNode // keyed by relay node's addr
+}
+
+// ReserveRelay sends a ReserveRelay request to relayNode, asking it to keep
+// a slot open so other peers can reach the local node through
+// relay://relayNode.Addr/<localID> when it cannot accept inbound
+// connections directly.
+func (c *Chord) ReserveRelay(relayNode *node.RemoteNode) error {
+	msg, err := newReserveRelayMessage(c.LocalNode.Id)
+	if err != nil {
+		return err
+	}
+
+	reply, err := relayNode.SendMessageSync(msg)
+	if err != nil {
+		c.recordPeerError(relayNode.Id, relayNode, "timeout")
+		return err
+	}
+
+	replyBody := &protobuf.ReserveRelayReply{}
+	if err := proto.Unmarshal(reply.Msg.Message, replyBody); err != nil {
+		c.recordPeerError(relayNode.Id, relayNode, "malformed")
+		return err
+	}
+
+	if !replyBody.Accepted {
+		return errors.New("chord: relay node declined reservation")
+	}
+
+	c.reservedOnLock.Lock()
+	if c.reservedOn == nil {
+		c.reservedOn = make(map[string]*node.RemoteNode)
+	}
+	c.reservedOn[relayNode.Addr] = relayNode
+	c.reservedOnLock.Unlock()
+
+	return nil
+}
+
+// refreshRelayReservations re-sends ReserveRelay for every slot this node
+// currently holds, on the same cadence stabilize() uses for everything
+// else, so a relay does not expire the reservation out from under it.
+func (c *Chord) refreshRelayReservations() {
+	subLogger := c.logger.With("subsys", "relay")
+
+	for {
+		if c.IsStopped() {
+			return
+		}
+
+		time.Sleep(randDuration(c.baseStabilizeInterval))
+
+		c.reservedOnLock.Lock()
+		relays := make([]*node.RemoteNode, 0, len(c.reservedOn))
+		for _, rn := range c.reservedOn {
+			relays = append(relays, rn)
+		}
+		c.reservedOnLock.Unlock()
+
+		for _, rn := range relays {
+			if err := c.ReserveRelay(rn); err != nil {
+				subLogger.With("rpc", "ReserveRelay", "remoteID", encodeHexID(rn.Id), "remoteAddr", rn.Addr, "errClass", "refresh").Error(err)
+			}
+		}
+	}
+}
+
+// handleReserveRelay is the relay-node side of the ReserveRelay RPC: it
+// records srcID -> remoteMsg.RemoteNode so a later Connect through
+// relay://localAddr/<srcID> can be forwarded.
+func (c *Chord) handleReserveRelay(remoteMsg *node.RemoteMessage) (proto.Message, error) {
+	body := &protobuf.ReserveRelay{}
+	if err := proto.Unmarshal(remoteMsg.Msg.Message, body); err != nil {
+		return nil, err
+	}
+
+	c.relayLock.Lock()
+	if c.reservations == nil {
+		c.reservations = make(map[string]*relayReservation)
+	}
+
+	accepted := true
+	_, held := c.reservations[string(remoteMsg.RemoteNode.Id)]
+	if !held && len(c.reservations) >= maxRelayReservationsTotal {
+		accepted = false
+	} else {
+		c.reservations[string(remoteMsg.RemoteNode.Id)] = &relayReservation{
+			conn:      remoteMsg.RemoteNode,
+			expiresAt: time.Now().Add(relayReservationTTL),
+		}
+	}
+	c.relayLock.Unlock()
+
+	return &protobuf.ReserveRelayReply{Accepted: accepted}, nil
+}
+
+// handleForwardRelay is the relay-node side of the ForwardRelay RPC: it
+// validates the request and returns the reply plus an afterReply callback
+// that dispatchRelayControlMsg runs only once the reply has actually gone
+// out. incoming is about to stop being a framed Chord connection and become
+// a raw tunnel, so nothing may read or write it again until the accept
+// message carrying that transition has itself been sent.
+func (c *Chord) handleForwardRelay(remoteMsg *node.RemoteMessage) (proto.Message, func(), error) {
+	body := &protobuf.ForwardRelay{}
+	if err := proto.Unmarshal(remoteMsg.Msg.Message, body); err != nil {
+		return nil, nil, err
+	}
+
+	incoming, ok := remoteMsg.RemoteNode.Conn.(net.Conn)
+	if !ok {
+		return &protobuf.ForwardRelayReply{Accepted: false}, nil, nil
+	}
+
+	rn := remoteMsg.RemoteNode
+	relayLogger := c.logger.With("subsys", "relay", "remoteID", encodeHexID(rn.Id))
+	afterReply := func() {
+		// rn's connection was only ever a means to negotiate this tunnel; it
+		// stops being a normal Chord neighbor the instant the accept reply
+		// above lands, so detach it from the node package's read/dispatch
+		// loop before forwardRelay starts reading and writing it directly.
+		// Without this, that loop and forwardRelay's io.Copy would consume
+		// the same socket concurrently.
+		rn.Stop(nil)
+		go func() {
+			if err := c.forwardRelay(body.TargetId, incoming); err != nil {
+				relayLogger.Error(err)
+			}
+		}()
+	}
+
+	return &protobuf.ForwardRelayReply{Accepted: true}, afterReply, nil
+}
+
+// dispatchRelayControlMsg handles RESERVE_RELAY and FORWARD_RELAY requests
+// directly, since they are relay-specific additions the generic
+// handleRemoteMessage dispatcher has no knowledge of. It reports whether
+// remoteMsg was one of these message types, so handleMsg can skip its usual
+// handleRemoteMessage/HandleRemoteMessage fallback for it.
+func (c *Chord) dispatchRelayControlMsg(remoteMsg *node.RemoteMessage) (bool, error) {
+	if remoteMsg == nil || remoteMsg.Msg == nil {
+		return false, nil
+	}
+
+	var (
+		reply      proto.Message
+		afterReply func()
+		err        error
+	)
+
+	switch remoteMsg.Msg.MessageType {
+	case protobuf.RESERVE_RELAY:
+		reply, err = c.handleReserveRelay(remoteMsg)
+	case protobuf.FORWARD_RELAY:
+		reply, afterReply, err = c.handleForwardRelay(remoteMsg)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	buf, err := proto.Marshal(reply)
+	if err != nil {
+		return true, err
+	}
+
+	if err := remoteMsg.RemoteNode.SendMessage(&protobuf.Message{
+		MessageType: remoteMsg.Msg.MessageType,
+		Message:     buf,
+	}); err != nil {
+		return true, err
+	}
+
+	if afterReply != nil {
+		afterReply()
+	}
+
+	return true, nil
+}
+
+// revokeRelayReservation drops any reservation rn holds, called from the
+// RemoteNodeDisconnected middleware so a dead connection cannot keep
+// forwarding.
+func (c *Chord) revokeRelayReservation(rn *node.RemoteNode) {
+	c.relayLock.Lock()
+	delete(c.reservations, string(rn.Id))
+	c.relayLock.Unlock()
+
+	c.reservedOnLock.Lock()
+	delete(c.reservedOn, rn.Addr)
+	c.reservedOnLock.Unlock()
+}
+
+// forwardRelay finds the reservation for targetID and pipes data
+// bidirectionally between incoming (the dialing peer's stream) and the
+// reserved connection, until either side closes or errors.
+func (c *Chord) forwardRelay(targetID []byte, incoming net.Conn) error {
+	c.relayLock.Lock()
+	res, ok := c.reservations[string(targetID)]
+	c.relayLock.Unlock()
+
+	if !ok || time.Now().After(res.expiresAt) {
+		return errors.New("chord: no live relay reservation for target")
+	}
+
+	target, ok := res.conn.Conn.(net.Conn)
+	if !ok {
+		return errors.New("chord: relay reservation has no forwardable connection")
+	}
+
+	// The reservation connection stops being a normal Chord neighbor the
+	// moment it starts carrying raw tunnel bytes instead of framed protobuf
+	// messages: detach it from the node package's read/dispatch loop first,
+	// same as handleForwardRelay does for incoming, or the two would read
+	// the same socket concurrently. The target will need a fresh
+	// ReserveRelay over a new connection once this tunnel closes.
+	res.conn.Stop(nil)
+
+	// Closing both ends as soon as either copy direction returns unblocks
+	// the other goroutine's Read instead of leaking it (and the underlying
+	// socket) until the far end happens to close on its own.
+	defer incoming.Close()
+	defer target.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(target, incoming)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(incoming, target)
+		errCh <- err
+	}()
+
+	return <-errCh
+}
+
+// connectViaRelay dials addr, a relay://<relayNodeAddr>/<targetID> address,
+// by first connecting to the relay node itself (a direct dial, since relay
+// nodes are themselves reachable, verified against the relay's own ID, not
+// targetID's) and then explicitly asking it to forward to targetID.
+func (c *Chord) connectViaRelay(addr string, id []byte) error {
+	ra, err := parseRelayAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Overlay.Connect(ra.relayNodeAddr, nil); err != nil {
+		return err
+	}
+
+	relayNode := c.neighbors.GetByAddr(ra.relayNodeAddr)
+	if relayNode == nil {
+		return errors.New("chord: relay node disconnected before forwarding could be requested")
+	}
+
+	msg, err := newForwardRelayMessage(id)
+	if err != nil {
+		return err
+	}
+
+	reply, err := relayNode.SendMessageSync(msg)
+	if err != nil {
+		c.recordPeerError(relayNode.Id, relayNode, "timeout")
+		return err
+	}
+
+	replyBody := &protobuf.ForwardRelayReply{}
+	if err := proto.Unmarshal(reply.Msg.Message, replyBody); err != nil {
+		c.recordPeerError(relayNode.Id, relayNode, "malformed")
+		return err
+	}
+
+	if !replyBody.Accepted {
+		return errors.New("chord: relay declined to forward to target " + encodeHexID(id))
+	}
+
+	tunnel, ok := relayNode.Conn.(net.Conn)
+	if !ok {
+		return errors.New("chord: relay connection has no forwardable transport")
+	}
+
+	// The connection to the relay node was only ever a means to negotiate
+	// this tunnel; once the relay accepts, it stops being a normal Chord
+	// neighbor and becomes the raw pipe to id, so detach it from the node
+	// package's dispatch loop (mirroring forwardRelay's handling of the
+	// target's side) before handing it to a RemoteNode of its own. Without
+	// this, id would never be reachable through successors, predecessors,
+	// fingerTable, or neighbors, since nothing else ever registers it.
+	relayNode.Stop(nil)
+
+	rn := &node.RemoteNode{
+		Id:         id,
+		Addr:       addr,
+		Conn:       tunnel,
+		IsOutbound: true,
+	}
+	c.addRemoteNode(rn)
+
+	return nil
+}
+
+// Connect recognizes relay addresses of the form
+// relay://<relayNodeAddr>/<targetID> and forwards through the relay node
+// instead of dialing targetID directly. Any other addr is dialed directly;
+// only if that dial fails and id is non-nil does it fall back to consulting
+// FindSuccessors(id, k) to discover a relay hop, since a NAT'd peer's
+// advertised Addr may not be directly dialable even though it looks like a
+// normal address.
+func (c *Chord) Connect(addr string, id []byte) error {
+	if isRelayAddr(addr) {
+		return c.connectViaRelay(addr, id)
+	}
+
+	err := c.Overlay.Connect(addr, id)
+	if err == nil || id == nil {
+		return err
+	}
+
+	succs, findErr := c.FindSuccessors(id, c.successors.Cap())
+	if findErr != nil {
+		return err
+	}
+
+	for _, succ := range succs {
+		if CompareID(succ.Id, id) == 0 && succ.Addr != addr {
+			// Recurse through c.Connect, not c.Overlay.Connect: succ.Addr may
+			// itself be a relay address if the discovered hop is also NAT'd,
+			// and only c.Connect knows how to route those.
+			return c.Connect(succ.Addr, id)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,37 @@
+package chord
+
+import "testing"
+
+func TestIsRelayAddr(t *testing.T) {
+	if !isRelayAddr("relay://10.0.0.1:30001/aabbcc") {
+		t.Errorf("relay:// address should be recognized as a relay address")
+	}
+	if isRelayAddr("10.0.0.1:30001") {
+		t.Errorf("a plain address should not be recognized as a relay address")
+	}
+}
+
+func TestParseAndFormatRelayAddr(t *testing.T) {
+	targetID := []byte{0xaa, 0xbb, 0xcc}
+	addr := formatRelayAddr("10.0.0.1:30001", targetID)
+
+	ra, err := parseRelayAddr(addr)
+	if err != nil {
+		t.Fatalf("parseRelayAddr(%q): %v", addr, err)
+	}
+	if ra.relayNodeAddr != "10.0.0.1:30001" {
+		t.Errorf("relayNodeAddr = %q, want %q", ra.relayNodeAddr, "10.0.0.1:30001")
+	}
+	if string(ra.targetID) != string(targetID) {
+		t.Errorf("targetID = %x, want %x", ra.targetID, targetID)
+	}
+}
+
+func TestParseRelayAddrMalformed(t *testing.T) {
+	if _, err := parseRelayAddr("relay://10.0.0.1:30001"); err == nil {
+		t.Errorf("parseRelayAddr should reject an address with no /<targetID> suffix")
+	}
+	if _, err := parseRelayAddr("relay://10.0.0.1:30001/not-hex"); err == nil {
+		t.Errorf("parseRelayAddr should reject a non-hex target ID")
+	}
+}
@@ -0,0 +1,98 @@
+package chord
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nknorg/nnet/node"
+	"github.com/nknorg/nnet/overlay/chord/transport"
+)
+
+// maxConcurrentHandshakes bounds how many Noise-IK responder handshakes may
+// be in flight at once before acceptUnderLoad tells incoming initiators to
+// retry with a cookie.
+const maxConcurrentHandshakes = 64
+
+// secureState holds the Noise-IK config and the Chord-ID -> static-public-key
+// cache the transport needs to dial out securely. Noise-IK's initiator must
+// already know the responder's static key (that's what the "IK" in the
+// pattern name means), but a Chord ID is only a one-way hash of that key, so
+// the local node learns a peer's key the first time that peer dials in
+// (transport.Accept always learns the initiator's key) and remembers it for
+// later outbound connects. Until a peer has reached us at least once,
+// outbound dials to it have no key to authenticate against and are rejected
+// rather than silently trusted in plaintext; see upgradeConn.
+type secureState struct {
+	secureConfig transport.SecureConfig
+
+	secureKeysLock sync.Mutex
+	secureKeys     map[string][32]byte
+
+	inFlightHandshakes int32 // atomic
+}
+
+// knownStaticKey returns the static public key previously learned for id, if
+// any.
+func (c *Chord) knownStaticKey(id []byte) ([32]byte, bool) {
+	c.secureKeysLock.Lock()
+	defer c.secureKeysLock.Unlock()
+	key, ok := c.secureKeys[string(id)]
+	return key, ok
+}
+
+// rememberStaticKey records static as the key behind remoteID, truncated to
+// this Chord network's ID length the same way RemoteNodeReady truncates it
+// when comparing against an announced ID.
+func (c *Chord) rememberStaticKey(remoteID [transport.IDSize]byte, static [32]byte) {
+	c.secureKeysLock.Lock()
+	if c.secureKeys == nil {
+		c.secureKeys = make(map[string][32]byte)
+	}
+	c.secureKeys[string(remoteID[:c.nodeIDBits/8])] = static
+	c.secureKeysLock.Unlock()
+}
+
+// TrustStaticKey pre-seeds the static-key cache with a key learned
+// out-of-band, e.g. a seed node's key shipped alongside its address in
+// operator config. Call this before Join/Connect when SecureTransport is
+// enabled and the peer has never dialed in before: Noise-IK gives the
+// initiator no way to learn the responder's key from the handshake itself
+// ("IK" means the initiator already knows it), so without a pre-seeded or
+// previously-learned key upgradeConn refuses the outbound connection rather
+// than trusting it in plaintext.
+func (c *Chord) TrustStaticKey(static [32]byte) {
+	c.rememberStaticKey(transport.IDFromStaticKey(static), static)
+}
+
+// acceptUnderLoad is the load signal transport.Accept uses to decide whether
+// to answer with a cookie reply instead of doing the expensive asymmetric
+// handshake crypto.
+func (c *Chord) acceptUnderLoad(net.Addr) bool {
+	return atomic.LoadInt32(&c.inFlightHandshakes) >= maxConcurrentHandshakes
+}
+
+// upgradeConn runs the Noise-IK handshake over rn's underlying connection,
+// called from the RemoteNodeReady middleware before rn is trusted. It
+// returns transport.ErrUnknownStaticKey when rn is outbound and the local
+// node has no static key on file for it yet, since IK cannot proceed without
+// one; the caller must reject the peer rather than fall back to trusting an
+// unauthenticated connection.
+func (c *Chord) upgradeConn(rn *node.RemoteNode) (*transport.SecureConn, error) {
+	conn, ok := rn.Conn.(net.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	if rn.IsOutbound {
+		remoteStatic, known := c.knownStaticKey(rn.Id)
+		if !known {
+			return nil, transport.ErrUnknownStaticKey
+		}
+		return transport.Dial(conn, c.secureConfig, remoteStatic)
+	}
+
+	atomic.AddInt32(&c.inFlightHandshakes, 1)
+	defer atomic.AddInt32(&c.inFlightHandshakes, -1)
+	return transport.Accept(conn, c.secureConfig, c.acceptUnderLoad)
+}
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// cookieRotationInterval bounds how long a cookie secret is reused. A
+// responder under load rotates its secret on this cadence so cookies from an
+// earlier window stop validating, limiting how long a captured cookie is
+// useful to an attacker.
+const cookieRotationInterval = 2 * time.Minute
+
+// cookieSecretState is the rotating HMAC secret behind issueCookie, scoped to
+// a single SecureConfig rather than shared package-wide: a process hosting
+// more than one Chord instance would otherwise have every instance issue and
+// validate cookies against the same secret under the same mutex, letting one
+// instance's handshake load or cookie accounting bleed into another's.
+type cookieSecretState struct {
+	mu       sync.Mutex
+	secret   [32]byte
+	rotateAt time.Time
+}
+
+func newCookieSecretState() *cookieSecretState {
+	return &cookieSecretState{}
+}
+
+func (s *cookieSecretState) current() [32]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().After(s.rotateAt) {
+		rand.Read(s.secret[:])
+		s.rotateAt = time.Now().Add(cookieRotationInterval)
+	}
+	return s.secret
+}
+
+// issueCookie computes a MAC1/MAC2-style cookie as keyed BLAKE2s(secret,
+// remoteAddr || initiationMsg), truncated to cookieSize. A responder under
+// load sends this back instead of completing the handshake; the initiator
+// must echo it verbatim in a second initiation attempt before the responder
+// will do the expensive asymmetric crypto.
+func issueCookie(cs *cookieSecretState, remoteAddr net.Addr, initMsg []byte) [cookieSize]byte {
+	secret := cs.current()
+
+	data := append([]byte(remoteAddr.String()), initMsg...)
+	mac := hmacBlake2s(secret[:], data)
+
+	var cookie [cookieSize]byte
+	copy(cookie[:], mac[:cookieSize])
+	return cookie
+}
@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// blake2sSum hashes b with BLAKE2s-256, matching the hash Noise uses for its
+// own chaining key and the one used to derive a node's Chord ID from its
+// static public key.
+func blake2sSum(b []byte) [32]byte {
+	return blake2s.Sum256(b)
+}
+
+// hmacBlake2s computes keyed BLAKE2s-256 (BLAKE2s's built-in MAC mode, not
+// the HMAC construction) of data under key, used by the MAC1/MAC2
+// cookie-reply anti-DoS scheme.
+func hmacBlake2s(key, data []byte) []byte {
+	h, err := blake2s.New256(key)
+	if err != nil {
+		// blake2s.New256 only errors on an oversized key, which never
+		// happens here since every caller passes a 32-byte key.
+		panic(err)
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func verifyMAC(key, data, mac []byte) bool {
+	return hmac.Equal(hmacBlake2s(key, data), mac)
+}
+
+// newStaticKeyPair generates a fresh Curve25519 identity.
+func newStaticKeyPair() (StaticKeyPair, error) {
+	var kp StaticKeyPair
+	if _, err := rand.Read(kp.Private[:]); err != nil {
+		return kp, err
+	}
+	curve25519.ScalarBaseMult(&kp.Public, &kp.Private)
+	return kp, nil
+}
+
+func dh(priv, pub [32]byte) ([32]byte, error) {
+	var shared [32]byte
+	out, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		return shared, err
+	}
+	copy(shared[:], out)
+	return shared, nil
+}
+
+func newAEAD(key [32]byte) (aeadCipher, error) {
+	return chacha20poly1305.New(key[:])
+}
+
+// aeadCipher is the subset of cipher.AEAD the handshake and session code
+// uses; named so tests can substitute a fake AEAD.
+type aeadCipher interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+	NonceSize() int
+	Overhead() int
+}
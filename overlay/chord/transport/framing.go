@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// maxFrameSize bounds a single framed message so a malicious or corrupt peer
+// cannot make readFramed allocate an unbounded buffer.
+const maxFrameSize = 64 * 1024
+
+var errFrameTooLarge = errors.New("transport: frame exceeds maxFrameSize")
+
+// writeFramed writes msg as a 4-byte big-endian length prefix followed by
+// its bytes, the same simple framing the plaintext fallback path uses so
+// SecureConn can be dropped in wherever a net.Conn is expected.
+func writeFramed(conn net.Conn, msg []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(msg)))
+	if _, err := conn.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+func readFramed(conn net.Conn) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,292 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// noiseIKProtocolName is the Noise protocol name identifying the exact
+// pattern and primitives in use, hashed into the initial chaining key as
+// required by the spec.
+const noiseIKProtocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+
+// handshakeState carries the symmetric state (chaining key + hash) shared by
+// both the IK message patterns: "-> e, es, s, ss" for the initiator and
+// "<- e, ee, se" for the responder.
+type handshakeState struct {
+	chainKey [32]byte
+	hash     [32]byte
+
+	local  StaticKeyPair
+	localE StaticKeyPair // ephemeral
+
+	remoteStatic [32]byte
+	remoteE      [32]byte
+}
+
+func newHandshakeState(local StaticKeyPair) handshakeState {
+	var hs handshakeState
+	hs.chainKey = blake2sSum([]byte(noiseIKProtocolName))
+	hs.hash = blake2sSum(hs.chainKey[:])
+	hs.local = local
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	hs.hash = blake2sSum(append(append([]byte{}, hs.hash[:]...), data...))
+}
+
+func (hs *handshakeState) mixKey(input []byte) {
+	hs.chainKey = blake2sSum(append(append([]byte{}, hs.chainKey[:]...), input...))
+}
+
+func (hs *handshakeState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	cipher, err := newAEAD(hs.chainKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, cipher.NonceSize())
+	ct := cipher.Seal(nil, nonce, plaintext, hs.hash[:])
+	hs.mixHash(ct)
+	return ct, nil
+}
+
+func (hs *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	cipher, err := newAEAD(hs.chainKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, cipher.NonceSize())
+	pt, err := cipher.Open(nil, nonce, ciphertext, hs.hash[:])
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	hs.mixHash(ciphertext)
+	return pt, nil
+}
+
+// initiatorHandshake drives the "-> e, es, s, ss" / "<- e, ee, se" exchange
+// from the side that already knows the responder's static public key.
+type initiatorHandshake struct {
+	hs           handshakeState
+	remoteStatic [32]byte
+}
+
+func newInitiatorHandshake(local StaticKeyPair, remoteStatic [32]byte) *initiatorHandshake {
+	return &initiatorHandshake{
+		hs:           newHandshakeState(local),
+		remoteStatic: remoteStatic,
+	}
+}
+
+// run performs the two-message IK exchange over conn and derives the
+// transport session keys. Timestamp is included in the initiator's
+// encrypted payload; the responder authenticates it as part of the
+// handshake but does not check its value, so a replayed initiation is not
+// rejected on that basis.
+func (i *initiatorHandshake) run(conn net.Conn) (*session, error) {
+	var err error
+	i.hs.localE, err = newStaticKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	i.hs.mixHash(i.remoteStatic[:])
+
+	// -> e
+	i.hs.mixHash(i.hs.localE.Public[:])
+
+	// es
+	es, err := dh(i.hs.localE.Private, i.remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	i.hs.mixKey(es[:])
+
+	// -> s (encrypted)
+	encStatic, err := i.hs.encryptAndHash(i.hs.local.Public[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// ss
+	ss, err := dh(i.hs.local.Private, i.remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	i.hs.mixKey(ss[:])
+
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
+	encTimestamp, err := i.hs.encryptAndHash(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	initMsg := marshalInitiation(i.hs.localE.Public, encStatic, encTimestamp)
+
+	respRaw, err := i.sendInitiationWithCookieRetry(conn, initMsg)
+	if err != nil {
+		return nil, err
+	}
+	respE, encEmpty, err := unmarshalResponse(respRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	i.hs.remoteE = respE
+	i.hs.mixHash(respE[:])
+
+	ee, err := dh(i.hs.localE.Private, respE)
+	if err != nil {
+		return nil, err
+	}
+	i.hs.mixKey(ee[:])
+
+	se, err := dh(i.hs.local.Private, respE)
+	if err != nil {
+		return nil, err
+	}
+	i.hs.mixKey(se[:])
+
+	if _, err := i.hs.decryptAndHash(encEmpty); err != nil {
+		return nil, err
+	}
+
+	return deriveSession(i.hs.chainKey, true)
+}
+
+// maxCookieRetries bounds how many times sendInitiationWithCookieRetry will
+// echo a fresh cookie back to a responder that keeps replying with one,
+// instead of retrying forever against a responder that is persistently
+// under load.
+const maxCookieRetries = 1
+
+// sendInitiationWithCookieRetry writes initMsg and reads back the response.
+// If the responder is under load it answers with a cookie reply instead of
+// completing the handshake; in that case this echoes the cookie back in a
+// second initiation attempt, as the responder's MAC1/MAC2 check requires,
+// and reads again. It echoes at most maxCookieRetries cookies and returns
+// ErrCookieRequired if the responder answers the last echo with yet another
+// cookie reply.
+func (i *initiatorHandshake) sendInitiationWithCookieRetry(conn net.Conn, initMsg []byte) ([]byte, error) {
+	msg := initMsg
+
+	for attempt := 0; ; attempt++ {
+		if err := writeFramed(conn, msg); err != nil {
+			return nil, err
+		}
+
+		respRaw, err := readFramed(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isCookieReply(respRaw) {
+			return respRaw, nil
+		}
+
+		if attempt >= maxCookieRetries {
+			return nil, ErrCookieRequired
+		}
+
+		cookie := respRaw[1:]
+		msg = appendCookie(initMsg, cookie)
+	}
+}
+
+// responderHandshake drives the responder side, replying with a cookie
+// under load instead of completing the handshake.
+type responderHandshake struct {
+	local        StaticKeyPair
+	cookieSecret *cookieSecretState
+}
+
+func newResponderHandshake(local StaticKeyPair, cookieSecret *cookieSecretState) *responderHandshake {
+	return &responderHandshake{local: local, cookieSecret: cookieSecret}
+}
+
+func (r *responderHandshake) run(conn net.Conn, underLoad func(net.Addr) bool) ([32]byte, *session, error) {
+	var remoteStatic [32]byte
+
+	raw, err := readFramed(conn)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+
+	if underLoad != nil && underLoad(conn.RemoteAddr()) {
+		cookie := issueCookie(r.cookieSecret, conn.RemoteAddr(), raw)
+		if err := writeFramed(conn, marshalCookieReply(cookie)); err != nil {
+			return remoteStatic, nil, err
+		}
+
+		raw, err = readFramed(conn)
+		if err != nil {
+			return remoteStatic, nil, err
+		}
+		if !messageEchoesCookie(raw, cookie) {
+			return remoteStatic, nil, ErrHandshakeFailed
+		}
+	}
+
+	initE, encStatic, encTimestamp, err := unmarshalInitiation(raw)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+
+	hs := newHandshakeState(r.local)
+	hs.mixHash(r.local.Public[:])
+	hs.mixHash(initE[:])
+
+	es, err := dh(r.local.Private, initE)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+	hs.mixKey(es[:])
+
+	staticBytes, err := hs.decryptAndHash(encStatic)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+	copy(remoteStatic[:], staticBytes)
+
+	ss, err := dh(r.local.Private, remoteStatic)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+	hs.mixKey(ss[:])
+
+	if _, err := hs.decryptAndHash(encTimestamp); err != nil {
+		return remoteStatic, nil, err
+	}
+
+	localE, err := newStaticKeyPair()
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+	hs.mixHash(localE.Public[:])
+
+	ee, err := dh(localE.Private, initE)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+	hs.mixKey(ee[:])
+
+	se, err := dh(localE.Private, remoteStatic)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+	hs.mixKey(se[:])
+
+	encEmpty, err := hs.encryptAndHash(nil)
+	if err != nil {
+		return remoteStatic, nil, err
+	}
+
+	if err := writeFramed(conn, marshalResponse(localE.Public, encEmpty)); err != nil {
+		return remoteStatic, nil, err
+	}
+
+	sess, err := deriveSession(hs.chainKey, false)
+	return remoteStatic, sess, err
+}
@@ -0,0 +1,71 @@
+package transport
+
+import "sync"
+
+// replayWindowSize is the width, in bits, of the sliding window used to
+// reject replayed messages. 64 bits comfortably covers realistic
+// reordering on a single Chord peer connection.
+const replayWindowSize = 64
+
+// replayWindow implements a standard sliding-bitmap replay filter keyed by
+// the monotonic per-session message counter.
+type replayWindow struct {
+	mu     sync.Mutex
+	top    uint64
+	bitmap uint64
+	init   bool
+}
+
+// validate reports whether counter n is acceptable: not already seen, and
+// not so far behind top that it falls outside the window. It does not mark
+// n as seen; call accept once the message has also passed AEAD
+// authentication, so a forged counter with an invalid tag cannot burn a slot
+// in the window.
+func (w *replayWindow) validate(n uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.init {
+		return true
+	}
+
+	if n > w.top {
+		return true
+	}
+
+	diff := w.top - n
+	if diff >= replayWindowSize {
+		return false
+	}
+
+	return w.bitmap&(1<<diff) == 0
+}
+
+// accept marks n as seen, advancing the window if n is the new high-water
+// mark.
+func (w *replayWindow) accept(n uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.init {
+		w.top = n
+		w.bitmap = 1
+		w.init = true
+		return
+	}
+
+	switch {
+	case n > w.top:
+		shift := n - w.top
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.top = n
+	default:
+		diff := w.top - n
+		w.bitmap |= 1 << diff
+	}
+}
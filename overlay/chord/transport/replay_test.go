@@ -0,0 +1,51 @@
+package transport
+
+import "testing"
+
+func TestReplayWindowRejectsDuplicateAndOldCounters(t *testing.T) {
+	var w replayWindow
+
+	if !w.validate(10) {
+		t.Fatalf("first counter should validate")
+	}
+	w.accept(10)
+
+	if w.validate(10) {
+		t.Fatalf("duplicate counter should not validate")
+	}
+
+	if !w.validate(12) {
+		t.Fatalf("higher counter should validate")
+	}
+	w.accept(12)
+
+	if !w.validate(11) {
+		t.Fatalf("counter within the window behind top should validate")
+	}
+	w.accept(11)
+
+	if w.validate(11) {
+		t.Fatalf("replaying 11 a second time should not validate")
+	}
+
+	w.accept(100)
+	if w.validate(100 - replayWindowSize) {
+		t.Fatalf("counter older than the window should not validate")
+	}
+}
+
+func TestReplayWindowAcceptsLargeForwardJump(t *testing.T) {
+	var w replayWindow
+
+	w.accept(5)
+	jump := uint64(5 + replayWindowSize + 100)
+
+	if !w.validate(jump) {
+		t.Fatalf("counter far ahead of top should validate")
+	}
+	w.accept(jump)
+
+	if w.validate(5) {
+		t.Fatalf("old counter should be outside the window after a large jump")
+	}
+}
@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// session holds the two derived ChaCha20-Poly1305 keys (one per direction)
+// and the per-direction state needed to frame and authenticate transport
+// messages after a successful handshake.
+type session struct {
+	send   aeadCipher
+	recv   aeadCipher
+	sendN  uint64 // atomic
+	recvWin replayWindow
+
+	createdAt time.Time
+}
+
+// deriveSession splits the final Noise chaining key into two directional
+// keys. Per the IK pattern the initiator's send key is the responder's recv
+// key and vice versa, so both sides pass the same chaining key and tell
+// deriveSession which side they are.
+func deriveSession(chainKey [32]byte, isInitiator bool) (*session, error) {
+	k1 := blake2sSum(append(append([]byte{}, chainKey[:]...), 0x01))
+	k2 := blake2sSum(append(append([]byte{}, chainKey[:]...), 0x02))
+
+	initiatorKey, responderKey := k1, k2
+
+	var sendKey, recvKey [32]byte
+	if isInitiator {
+		sendKey, recvKey = initiatorKey, responderKey
+	} else {
+		sendKey, recvKey = responderKey, initiatorKey
+	}
+
+	send, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		send:      send,
+		recv:      recv,
+		createdAt: time.Now(),
+	}, nil
+}
+
+// encrypt seals plaintext under the next send counter, prefixing the
+// 8-byte counter so the peer can reconstruct the nonce and check it against
+// its replay window.
+func (s *session) encrypt(plaintext []byte) ([]byte, error) {
+	n := atomic.AddUint64(&s.sendN, 1) - 1
+
+	nonce := make([]byte, s.send.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+
+	ct := s.send.Seal(nil, nonce, plaintext, nil)
+
+	out := make([]byte, 8+len(ct))
+	binary.LittleEndian.PutUint64(out, n)
+	copy(out[8:], ct)
+	return out, nil
+}
+
+// decrypt validates the leading counter against the sliding replay window
+// before attempting to open the ciphertext.
+func (s *session) decrypt(msg []byte) ([]byte, error) {
+	if len(msg) < 8 {
+		return nil, errMalformedMessage
+	}
+
+	n := binary.LittleEndian.Uint64(msg[:8])
+	if !s.recvWin.validate(n) {
+		return nil, ErrReplayed
+	}
+
+	nonce := make([]byte, s.recv.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+
+	plain, err := s.recv.Open(nil, nonce, msg[8:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recvWin.accept(n)
+	return plain, nil
+}
+
+// needsRekey reports whether this session has carried enough traffic or
+// aged long enough that the caller should drop it and re-handshake, per
+// cfg.RekeyAfterMessages / cfg.RekeyAfterDuration.
+func (s *session) needsRekey(cfg SecureConfig) bool {
+	if cfg.RekeyAfterMessages > 0 && atomic.LoadUint64(&s.sendN) >= cfg.RekeyAfterMessages {
+		return true
+	}
+	if cfg.RekeyAfterDuration > 0 && time.Since(s.createdAt) >= cfg.RekeyAfterDuration {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+// Package transport implements an authenticated, encrypted transport for
+// Chord peer connections, based on the Noise-IK handshake pattern. A node's
+// Chord ID is derived from its long-term static public key instead of being
+// a self-asserted byte string, and all post-handshake traffic is wrapped in
+// ChaCha20-Poly1305 with per-direction keys.
+//
+// The plaintext path remains available (see config.Config.SecureTransport)
+// so existing tests and tooling that dial a net.Conn directly keep working.
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nnet/log"
+)
+
+// IDSize is the length in bytes of the Chord node ID derived from a static
+// public key. Callers truncate it further to config.Config.NodeIDBytes.
+const IDSize = 32
+
+var (
+	// ErrHandshakeFailed is returned when a Noise-IK handshake does not
+	// complete, e.g. because an encrypted handshake field fails to
+	// authenticate or a cookie echo does not match the issued cookie.
+	ErrHandshakeFailed = errors.New("transport: handshake failed")
+
+	// ErrIDMismatch is returned when the ID announced by a peer does not
+	// match H(staticPubKey) derived during the handshake.
+	ErrIDMismatch = errors.New("transport: announced node ID does not match handshake-derived ID")
+
+	// ErrCookieRequired is returned by Dial when the responder replied with a
+	// cookie on every attempt up to maxCookieRetries; the initiator already
+	// retries the handshake with the echoed cookie internally; this error
+	// only surfaces once that retry budget is exhausted, which means the
+	// responder is still under load.
+	ErrCookieRequired = errors.New("transport: responder requires cookie reply")
+
+	// ErrReplayed is returned when a transport message's counter falls
+	// outside the receive window.
+	ErrReplayed = errors.New("transport: replayed or out-of-window message")
+
+	// ErrUnknownStaticKey is returned when an outbound IK handshake is
+	// attempted against a peer whose static public key the local node has
+	// not yet learned. IK requires the initiator to know the responder's
+	// static key up front, so there is no safe way to proceed; callers must
+	// not fall back to trusting the connection unauthenticated.
+	ErrUnknownStaticKey = errors.New("transport: no known static key for outbound peer")
+
+	// ErrRekeyRequired is returned by SecureConn.Write once a session has
+	// carried more traffic or aged longer than SecureConfig.RekeyAfterMessages
+	// / RekeyAfterDuration allow. The session is dropped as part of returning
+	// this error; the caller must close the connection and reconnect to
+	// trigger a fresh handshake, since this transport does not support
+	// renegotiating keys in place.
+	ErrRekeyRequired = errors.New("transport: session exceeded rekey threshold, reconnect required")
+)
+
+// StaticKeyPair is a node's long-term Curve25519 identity used to derive its
+// Chord ID and to authenticate the Noise-IK handshake.
+type StaticKeyPair struct {
+	Private [32]byte
+	Public  [32]byte
+}
+
+// SecureConfig holds the knobs engaged by config.Config.SecureTransport.
+type SecureConfig struct {
+	// StaticKey is the local node's long-term identity.
+	StaticKey StaticKeyPair
+
+	// HandshakeTimeout bounds how long Dial/Accept wait for the handshake
+	// to complete before giving up.
+	HandshakeTimeout time.Duration
+
+	// RekeyAfterMessages and RekeyAfterDuration bound how much traffic or
+	// time a derived session key is used for before a fresh handshake is
+	// required.
+	RekeyAfterMessages uint64
+	RekeyAfterDuration time.Duration
+
+	// cookieSecret is the responder-side anti-DoS cookie secret, scoped to
+	// this SecureConfig so it isn't shared with any other Chord instance in
+	// the same process. Set by DefaultSecureConfig; nil only for a
+	// zero-value SecureConfig a caller built by hand.
+	cookieSecret *cookieSecretState
+}
+
+// DefaultSecureConfig returns the handshake timeout and rekey limits NewChord
+// starts from. Dial and Accept also fall back to it when cfg.HandshakeTimeout
+// is not positive, replacing the whole cfg, StaticKey included.
+func DefaultSecureConfig() SecureConfig {
+	return SecureConfig{
+		HandshakeTimeout:   5 * time.Second,
+		RekeyAfterMessages: 1 << 20,
+		RekeyAfterDuration: 2 * time.Minute,
+		cookieSecret:       newCookieSecretState(),
+	}
+}
+
+// NewStaticKeyPair generates a fresh Curve25519 identity suitable for
+// SecureConfig.StaticKey.
+func NewStaticKeyPair() (StaticKeyPair, error) {
+	return newStaticKeyPair()
+}
+
+// IDFromStaticKey derives the Chord node ID from a static public key, as
+// H(staticPubKey) truncated to nodeIDBytes by the caller.
+func IDFromStaticKey(pub [32]byte) [IDSize]byte {
+	return blake2sSum(pub[:])
+}
+
+// SecureConn is an authenticated, encrypted net.Conn wrapping a plaintext
+// transport connection after a successful Noise-IK handshake.
+type SecureConn struct {
+	net.Conn
+
+	remoteStatic [32]byte
+	remoteID     [IDSize]byte
+
+	mu      sync.Mutex
+	session *session
+
+	cfg SecureConfig
+
+	// leftover holds plaintext decrypted in a previous Read that didn't fit
+	// in the caller's buffer. readFramed/decrypt operate on whole transport
+	// messages, so a Read smaller than one message must carry the remainder
+	// forward instead of discarding it, the way any stream-oriented Read
+	// wrapping a message-oriented source has to.
+	leftover []byte
+}
+
+// RemoteID returns the handshake-derived Chord ID of the peer at the other
+// end of the connection. Callers compare this against the ID a RemoteNode
+// announces and reject the node on mismatch.
+func (c *SecureConn) RemoteID() [IDSize]byte {
+	return c.remoteID
+}
+
+// RemoteStatic returns the peer's long-term Curve25519 static public key
+// learned during the handshake, so a responder can remember it and dial that
+// peer securely itself later, when it could not have known the key in
+// advance.
+func (c *SecureConn) RemoteStatic() [32]byte {
+	return c.remoteStatic
+}
+
+// Read decrypts and returns the next transport message, buffering any
+// plaintext that doesn't fit in p so a caller reading in small chunks sees
+// the full stream instead of losing whatever didn't fit on the first call.
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	sess := c.session
+	leftover := c.leftover
+	c.leftover = nil
+	c.mu.Unlock()
+
+	if leftover != nil {
+		n := copy(p, leftover)
+		if n < len(leftover) {
+			c.mu.Lock()
+			c.leftover = leftover[n:]
+			c.mu.Unlock()
+		}
+		return n, nil
+	}
+
+	if sess == nil {
+		return 0, ErrHandshakeFailed
+	}
+
+	msg, err := readFramed(c.Conn)
+	if err != nil {
+		return 0, err
+	}
+
+	plain, err := sess.decrypt(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, plain)
+	if n < len(plain) {
+		c.mu.Lock()
+		c.leftover = plain[n:]
+		c.mu.Unlock()
+	}
+	return n, nil
+}
+
+// Write encrypts and frames p as a single transport message.
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	sess := c.session
+	c.mu.Unlock()
+
+	if sess == nil {
+		return 0, ErrHandshakeFailed
+	}
+
+	if sess.needsRekey(c.cfg) {
+		c.mu.Lock()
+		c.session = nil
+		c.mu.Unlock()
+		log.Warn("transport: session exceeded rekey threshold, dropping it; peer must re-handshake")
+		return 0, ErrRekeyRequired
+	}
+
+	msg, err := sess.encrypt(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), writeFramed(c.Conn, msg)
+}
+
+// Dial opens conn as an initiator, performs the Noise-IK handshake against
+// remoteStatic, and returns the resulting SecureConn. The peer's announced ID
+// is verified by the caller against RemoteID (IDFromStaticKey(remoteStatic))
+// once the handshake is confirmed, as Chord's RemoteNodeReady middleware does
+// before it calls addRemoteNode.
+func Dial(conn net.Conn, cfg SecureConfig, remoteStatic [32]byte) (*SecureConn, error) {
+	if cfg.HandshakeTimeout <= 0 {
+		cfg = DefaultSecureConfig()
+	}
+
+	deadline := time.Now().Add(cfg.HandshakeTimeout)
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newInitiatorHandshake(cfg.StaticKey, remoteStatic)
+
+	sess, err := hs.run(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecureConn{
+		Conn:         conn,
+		remoteStatic: remoteStatic,
+		remoteID:     IDFromStaticKey(remoteStatic),
+		session:      sess,
+		cfg:          cfg,
+	}, nil
+}
+
+// Accept performs the responder side of the Noise-IK handshake over conn,
+// answering with a cookie reply first if underLoad is true.
+func Accept(conn net.Conn, cfg SecureConfig, underLoad func(remoteAddr net.Addr) bool) (*SecureConn, error) {
+	if cfg.HandshakeTimeout <= 0 {
+		cfg = DefaultSecureConfig()
+	}
+	if cfg.cookieSecret == nil {
+		cfg.cookieSecret = newCookieSecretState()
+	}
+
+	deadline := time.Now().Add(cfg.HandshakeTimeout)
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newResponderHandshake(cfg.StaticKey, cfg.cookieSecret)
+
+	remoteStatic, sess, err := hs.run(conn, underLoad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecureConn{
+		Conn:         conn,
+		remoteStatic: remoteStatic,
+		remoteID:     IDFromStaticKey(remoteStatic),
+		session:      sess,
+		cfg:          cfg,
+	}, nil
+}
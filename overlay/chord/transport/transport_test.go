@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func handshakeOverPipe(t *testing.T, underLoad func(net.Addr) bool) (client *SecureConn, server *SecureConn) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	clientKey, err := NewStaticKeyPair()
+	if err != nil {
+		t.Fatalf("NewStaticKeyPair: %v", err)
+	}
+	serverKey, err := NewStaticKeyPair()
+	if err != nil {
+		t.Fatalf("NewStaticKeyPair: %v", err)
+	}
+
+	serverCfg := DefaultSecureConfig()
+	serverCfg.StaticKey = serverKey
+
+	type acceptResult struct {
+		conn *SecureConn
+		err  error
+	}
+	acceptCh := make(chan acceptResult, 1)
+	go func() {
+		sc, err := Accept(serverConn, serverCfg, underLoad)
+		acceptCh <- acceptResult{sc, err}
+	}()
+
+	clientCfg := DefaultSecureConfig()
+	clientCfg.StaticKey = clientKey
+
+	client, err = Dial(clientConn, clientCfg, serverKey.Public)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	res := <-acceptCh
+	if res.err != nil {
+		t.Fatalf("Accept: %v", res.err)
+	}
+
+	return client, res.conn
+}
+
+func TestDialAcceptRoundTrip(t *testing.T) {
+	client, server := handshakeOverPipe(t, nil)
+
+	if client.RemoteID() != IDFromStaticKey(server.cfg.StaticKey.Public) {
+		t.Errorf("client's view of server ID does not match server's static key")
+	}
+
+	msg := []byte("hello chord")
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := client.Write(msg)
+		writeErrCh <- err
+	}()
+
+	buf := make([]byte, len(msg))
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := <-writeErrCh; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if string(buf[:n]) != string(msg) {
+		t.Errorf("got %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestReadBuffersLeftoverAcrossShortReads(t *testing.T) {
+	client, server := handshakeOverPipe(t, nil)
+
+	msg := []byte("hello chord")
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := client.Write(msg)
+		writeErrCh <- err
+	}()
+
+	var got []byte
+	buf := make([]byte, 4)
+	for len(got) < len(msg) {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if err := <-writeErrCh; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+}
+
+func TestDialRetriesOnSingleCookieReply(t *testing.T) {
+	// Accept only consults underLoad once, so always-true exercises exactly
+	// the one cookie round-trip Dial's retry budget allows.
+	client, server := handshakeOverPipe(t, func(net.Addr) bool { return true })
+
+	if client.RemoteID() != IDFromStaticKey(server.cfg.StaticKey.Public) {
+		t.Errorf("handshake did not complete after echoing the cookie")
+	}
+}
+
+func TestDialGivesUpAfterRepeatedCookieReplies(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	cookieSecret := newCookieSecretState()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Dial sends the initiation plus one echo per allowed retry.
+		for i := 0; i < maxCookieRetries+1; i++ {
+			raw, err := readFramed(serverConn)
+			if err != nil {
+				return
+			}
+			cookie := issueCookie(cookieSecret, serverConn.RemoteAddr(), raw)
+			if err := writeFramed(serverConn, marshalCookieReply(cookie)); err != nil {
+				return
+			}
+		}
+	}()
+
+	clientKey, err := NewStaticKeyPair()
+	if err != nil {
+		t.Fatalf("NewStaticKeyPair: %v", err)
+	}
+	remoteKey, err := NewStaticKeyPair()
+	if err != nil {
+		t.Fatalf("NewStaticKeyPair: %v", err)
+	}
+
+	cfg := DefaultSecureConfig()
+	cfg.StaticKey = clientKey
+
+	_, err = Dial(clientConn, cfg, remoteKey.Public)
+	if err != ErrCookieRequired {
+		t.Fatalf("Dial() error = %v, want ErrCookieRequired", err)
+	}
+
+	<-done
+}
+
+func TestWriteNeedsRekeyDropsSession(t *testing.T) {
+	client, server := handshakeOverPipe(t, nil)
+	client.cfg.RekeyAfterMessages = 1
+	client.cfg.RekeyAfterDuration = 0
+
+	// net.Pipe is unbuffered, so the first Write only returns once the
+	// server side reads it.
+	go server.Read(make([]byte, 64))
+
+	if _, err := client.Write([]byte("first")); err != nil {
+		t.Fatalf("first Write: %v", err)
+	}
+
+	_, err := client.Write([]byte("second"))
+	if err != ErrRekeyRequired {
+		t.Fatalf("second Write() error = %v, want ErrRekeyRequired", err)
+	}
+
+	if _, err := client.Write([]byte("third")); err != ErrHandshakeFailed {
+		t.Fatalf("Write after rekey drop error = %v, want ErrHandshakeFailed", err)
+	}
+}
+
+func TestSessionNeedsRekeyAfterMessages(t *testing.T) {
+	client, _ := handshakeOverPipe(t, nil)
+
+	cfg := DefaultSecureConfig()
+	cfg.RekeyAfterMessages = 5
+	cfg.RekeyAfterDuration = 0
+
+	atomic.StoreUint64(&client.session.sendN, 4)
+	if client.session.needsRekey(cfg) {
+		t.Fatalf("needsRekey is true before the message threshold is reached")
+	}
+
+	atomic.StoreUint64(&client.session.sendN, 5)
+	if !client.session.needsRekey(cfg) {
+		t.Fatalf("needsRekey is false once the message threshold is reached")
+	}
+}